@@ -3,10 +3,12 @@ package discover
 import (
 	"bytes"
 	"crypto/rand"
-	"encoding/binary"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -25,6 +27,10 @@ func init() {
 		log.Fatalln("could not generate a dedupe id:", err)
 	}
 	dedupe = dedupe[0:LEN_DEDUPE]
+	nonceKey, err = randMsg()
+	if err != nil {
+		log.Fatalln("could not generate a nonce key:", err)
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////
@@ -32,17 +38,60 @@ func init() {
 type AuthClient struct {
 	AppPort    int
 	Passphrase []byte
-	Timeout    int
+	Timeout    int // milliseconds we wait for a response
+	Retries    int // times the challenge is sent before giving up
+
+	// Key derivation scheme. If LegacyKDF is true, peers that do not answer
+	// are verified again with KDF_LEGACY.
+	KDF       byte
+	LegacyKDF bool
+
+	// If true, responses of older peers that answer our challenges at once,
+	// without asking us to prove that we know the passphrase, are accepted.
+	LegacyAuth bool
+
+	// If true, peers are verified with a Noise handshake (see noise.go).
+	Noise bool
+
+	mu     sync.Mutex
+	wire   map[string]byte         // framing of the peers that answered, by address
+	silent map[silentKey]time.Time // candidates that answered no framing, until when they are skipped
+
+	logger *slog.Logger
+}
+
+// Identifies a candidate verified with a passphrase, which it may not know.
+type silentKey struct {
+	address string
+	key     keyID
 }
 
 // creates a new authentication server/client
 func NewAuthClient(appPort int, passphrase []byte) (*AuthClient, error) {
-	log.Printf("Creating authentication client")
+	config := DefaultConfig()
+	return newAuthClient(appPort, passphrase, &config), nil
+}
+
+// creates a new authentication client, with the timeouts and logger in config
+func newAuthClient(appPort int, passphrase []byte, config *Config) *AuthClient {
 	return &AuthClient{
 		AppPort:    appPort,
 		Passphrase: passphrase,
-		Timeout:    DEFAULT_TIMEOUT,
-	}, nil
+		Timeout:    int(config.VerifyTimeout / time.Millisecond),
+		Retries:    config.VerifyRetries,
+		KDF:        config.KDF,
+		LegacyKDF:  config.LegacyKDF,
+		LegacyAuth: config.LegacyAuth,
+		Noise:      config.Noise,
+		logger:     config.Logger.With("stage", "verify"),
+	}
+}
+
+// forgets the framing of the peer at address, when it is no longer known
+func (a *AuthClient) forget(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.wire, address)
 }
 
 // Verify connects to a host:port address specified in peer and sends it a
@@ -51,23 +100,102 @@ func NewAuthClient(appPort int, passphrase []byte) (*AuthClient, error) {
 // valid Peer and returns the details. If the connection fails or the peer
 // authentication fails, returns an error.
 func (a *AuthClient) Verify(address string) (*Response, error) {
-	return a.verifyUDP(address)
+	return a.verify(address, a.Passphrase)
+}
+
+// verifies a peer using a passphrase other than our own, with our key
+// derivation scheme and then, if needed, with the legacy one.
+func (a *AuthClient) verify(address string, passphrase []byte) (response *Response, err error) {
+	for _, version := range kdfVersions(a.KDF, a.LegacyKDF) {
+		keys, kErr := deriveKeys(passphrase, version)
+		if kErr != nil {
+			return nil, kErr
+		}
+		response, err = a.verifyKeys(address, keys)
+		if err != ERR_DID_NOT_RESPOND && err != ERR_DID_NOT_VERIFY {
+			return response, err
+		}
+	}
+	return response, err
+}
+
+// verifies a peer using keys. The challenge is sent again if the peer does not
+// respond, up to Retries times. With Noise, the peers are sent a Noise
+// handshake; otherwise, peers that never answered are sent v2 frames,
+// and then v1 messages; afterwards, they are sent what they answered. Those
+// answering neither are not tried again for SILENT_CANDIDATE_TIME.
+func (a *AuthClient) verifyKeys(address string, keys *keySet) (response *Response, err error) {
+	if a.Noise {
+		for attempt := 0; attempt < a.Retries || attempt == 0; attempt++ {
+			if response, err = a.verifyNoise(address, keys); err != ERR_DID_NOT_RESPOND {
+				return response, err
+			}
+		}
+		return response, err
+	}
+
+	versions := []byte{WIRE_V2, WIRE_V1}
+	silent := silentKey{address: address, key: keyID{hint: keys.hint, kdf: keys.version}}
+	a.mu.Lock()
+	version, found := a.wire[address]
+	if found {
+		versions = []byte{version}
+	} else if time.Now().Before(a.silent[silent]) {
+		a.mu.Unlock()
+		return nil, ERR_DID_NOT_RESPOND
+	}
+	a.mu.Unlock()
+
+	for _, version := range versions {
+		for attempt := 0; attempt < a.Retries || attempt == 0; attempt++ {
+			if response, err = a.verifyUDP(address, keys, version); err != ERR_DID_NOT_RESPOND {
+				if err == nil {
+					a.mu.Lock()
+					if a.wire == nil {
+						a.wire = make(map[string]byte)
+					}
+					a.wire[address] = version
+					a.mu.Unlock()
+				}
+				return response, err
+			}
+		}
+	}
+	if !found {
+		a.skip(silent)
+	}
+	return response, err
+}
+
+// skips a candidate that answered no framing for SILENT_CANDIDATE_TIME,
+// forgetting those skipped long enough
+func (a *AuthClient) skip(silent silentKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.silent == nil {
+		a.silent = make(map[silentKey]time.Time)
+	}
+	maps.DeleteFunc(a.silent, func(_ silentKey, until time.Time) bool { return now.After(until) })
+	a.silent[silent] = now.Add(SILENT_CANDIDATE_TIME)
 }
 
 // Verify connects to a host:port address specified in peer and sends it a
-// cryptographic challenge. If the peer responds with a valid MAC that appears
-// to have been generated with the shared secret in passphrase, consider it a
-// valid Peer and returns the details. If the connection fails or the peer
-// authentication fails, returns an error.
-func (a *AuthClient) verifyUDP(address string) (*Response, error) {
-	log.Printf("Verifying %s UDP", address)
+// cryptographic challenge. The peer answers with a nonce, and we send back
+// proof that we know the passphrase. If the peer then responds with a valid
+// MAC that appears to have been generated with the shared secret in
+// passphrase, consider it a valid Peer and returns the details. If the
+// connection fails or the peer authentication fails, returns an error. The
+// messages are sent with the framing in version.
+func (a *AuthClient) verifyUDP(address string, keys *keySet, version byte) (*Response, error) {
+	a.logger.Debug("verifying peer", "peer", address, "wire", version)
 	if challenge, err := NewChallenge(); err != nil {
 		return nil, fmt.Errorf("could not create a challenge: %v", err)
 	} else {
-		challengeBuf, _ := challenge.ToBuffer()
-		if err := binary.Write(challengeBuf, binary.LittleEndian, challenge); err != nil {
-			// The other side is either unreachable or we connected to
-			// ourselves and closed the connection.
+		challenge.KeyHint = keys.hint
+		challenge.KDF = keys.version
+		challenge.Flags = FLAG_METADATA | FLAG_ENDPOINTS | FLAG_HOSTS | FLAG_IDENTITY | FLAG_MUTUAL
+		if challengeBuf, err := encodeMessage(challenge, version); err != nil {
 			return nil, ERR_IS_NOT_PEER
 		} else {
 			// send the challenge with UDP
@@ -79,31 +207,68 @@ func (a *AuthClient) verifyUDP(address string) (*Response, error) {
 				} else {
 					// set the cleanup and some timeout for the connection
 					defer udpConn.Close()
-					udpConn.SetDeadline(time.Now().Add(300 * time.Millisecond))
+					udpConn.SetDeadline(time.Now().Add(time.Duration(a.Timeout) * time.Millisecond))
 
-					if _, err := udpConn.Write(challengeBuf.Bytes()); err != nil {
-						// The other side is either unreachable or we connected to
-						// ourselves and closed the connection.
-						return nil, ERR_COULD_NOT_SEND
+					buf, err := exchange(udpConn, challengeBuf)
+					if err != nil {
+						return nil, err
+					}
+					var nonce *Nonce
+					if version == WIRE_V2 {
+						nonce, err = parseNonceFrame(buf)
 					} else {
-						responseBuffer := new(bytes.Buffer)
-
-						if _, _, err := udpConn.ReadFrom(responseBuffer.Bytes()); err != nil {
-							return nil, ERR_DID_NOT_RESPOND
-						} else {
-							response, ok := challenge.VerifyResponse(responseBuffer, a.Passphrase)
-							if ok {
-								log.Printf("Found a valid peer at %s !!!", address)
-								return response, nil
-							} else {
-								return nil, ERR_DID_NOT_VERIFY
-							}
+						nonce, err = parseNonce(buf)
+					}
+					if err == nil && nonce.Challenge == challenge.Challenge {
+						if !allowSelfConnection && bytes.Equal(nonce.Dedupe[:], dedupe) {
+							return nil, ERR_SELF_CONNECTION
+						}
+						proofBuf, err := encodeMessage(challenge.NewProof(nonce, keys.mac), version)
+						if err != nil {
+							return nil, ERR_IS_NOT_PEER
 						}
+						if buf, err = exchange(udpConn, proofBuf); err != nil {
+							return nil, err
+						}
+					} else if !a.LegacyAuth || version == WIRE_V2 {
+						// an older peer, or someone pretending to be one
+						return nil, ERR_DID_NOT_VERIFY
+					} else {
+						nonce = nil
+					}
+					var response *Response
+					var ok bool
+					if version == WIRE_V2 {
+						response, ok = challenge.verifyResponseFrame(buf, nonce, keys.mac)
+					} else {
+						response, ok = challenge.VerifyResponse(bytes.NewBuffer(buf), nonce, keys.mac)
+					}
+					if ok {
+						if nonce != nil {
+							response.Session = newSession(keys.enc, transcript(challenge, nonce))
+						}
+						a.logger.Debug("peer verified", "peer", address)
+						return response, nil
+					} else {
+						return nil, ERR_DID_NOT_VERIFY
 					}
 				}
 			}
 		}
 	}
+}
 
-	return nil, nil
+// sends msg to the peer and returns its answer
+func exchange(conn *net.UDPConn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		// The other side is either unreachable or we connected to
+		// ourselves and closed the connection.
+		return nil, ERR_COULD_NOT_SEND
+	}
+	buf := make([]byte, LEN_UDP_BUF)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, ERR_DID_NOT_RESPOND
+	}
+	return buf[:n], nil
 }
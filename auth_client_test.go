@@ -3,7 +3,12 @@ package discover
 import (
 	"bytes"
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type rwc struct {
@@ -21,48 +26,293 @@ func addrLocal(addr net.Addr) string {
 	return net.JoinHostPort("localhost", port)
 }
 
-func TestAuth(t *testing.T) {
-	// Ignore the dedupe ID check.
+// lets the test verify its own servers, although they have the same dedupe
+// ID as its clients, until it ends
+func allowSelf(t *testing.T) {
 	allowSelfConnection = true
+	t.Cleanup(func() { allowSelfConnection = false })
+}
+
+// starts server for the test, which can verify it, and closes it when the
+// test ends
+func startServer(t *testing.T, server *AuthServer) {
+	allowSelf(t)
+	if err := server.ListenAndServe(); err != nil {
+		t.Fatalf("listenAuth error %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+}
 
+func TestAuth(t *testing.T) {
 	passphrase := []byte("secret")
 	want := "localhost:3000"
 
-	res := NewAuthResolverTCP(60000, 31337, passphrase)
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
 
 	// Starts server in the background.
-	addr, err := res.ListenAndServe()
-	if err != nil {
-		t.Fatalf("listenAuth error %v", err)
-	}
+	startServer(t, server)
 
 	// Client.
-	peer, err := res.Verify(addrLocal(addr))
+	client, _ := NewAuthClient(31337, passphrase)
+	response, err := client.Verify(addrLocal(server.Addr()))
 	if err != nil {
-		t.Errorf("auth: %v", err)
+		t.Fatalf("auth: %v", err)
 	}
 
+	peer := Peer{Addr: net.JoinHostPort("localhost", strconv.Itoa(int(response.Port)))}
 	if peer.String() != want {
 		t.Errorf("Wanted peer %v, got %v", want, peer.String())
 	}
 
-	allowSelfConnection = false
+	server.Close()
 }
 
 func TestBrokenAuth(t *testing.T) {
-	// Ignore the dedupe ID check.
-	allowSelfConnection = true
 	passphrase := []byte("secrettwo")
 
 	// Starts server in the background.
-	addr, err := listenAuth(0, 3000, passphrase)
-	if err != nil {
-		t.Fatalf("listenAuth error %v", err)
-	}
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
 
 	// Connect to the server and tries to verify it.
-	if _, err := verifyPeer(addrLocal(addr), []byte("someotherpass")); err == nil {
+	client, _ := NewAuthClient(0, []byte("someotherpass"))
+	if _, err := client.Verify(addrLocal(server.Addr())); err == nil {
 		t.Fatalf("Expected an error for failed auth, got nil")
 	}
-	allowSelfConnection = false
+	server.Close()
+}
+
+func TestAuthSeveralKeys(t *testing.T) {
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, []byte("dns"))
+	if err := server.AddKey([]byte("ldap"), 4000); err != nil {
+		t.Fatalf("AddKey error %v", err)
+	}
+	if err := server.AddKey([]byte("ldap"), 4001); err == nil {
+		t.Errorf("Expected an error adding the same key twice, got nil")
+	}
+	startServer(t, server)
+
+	client, _ := NewAuthClient(0, nil)
+	for passphrase, want := range map[string]uint16{"dns": 3000, "ldap": 4000} {
+		response, err := client.verify(addrLocal(server.Addr()), []byte(passphrase))
+		if err != nil {
+			t.Errorf("auth %s: %v", passphrase, err)
+		} else if response.Port != want {
+			t.Errorf("Wanted port %d for %s, got %d", want, passphrase, response.Port)
+		}
+	}
+	if _, err := client.verify(addrLocal(server.Addr()), []byte("ntp")); err == nil {
+		t.Errorf("Expected an error for an unknown key, got nil")
+	}
+
+	server.Close()
+}
+
+func TestAuthIPv6(t *testing.T) {
+	allowSelf(t)
+	server, _ := NewAuthServer("[::1]:0", 3000, []byte("secret"))
+	if err := server.ListenAndServe(); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+
+	client, _ := NewAuthClient(0, []byte("secret"))
+	if response, err := client.Verify(server.Addr().String()); err != nil {
+		t.Errorf("auth: %v", err)
+	} else if response.Port != 3000 {
+		t.Errorf("Wanted port 3000, got %d", response.Port)
+	}
+
+	server.Close()
+}
+
+func TestAuthLegacyKDF(t *testing.T) {
+	// an older node
+	config := DefaultConfig()
+	config.KDF = KDF_LEGACY
+	server := newAuthServer("127.0.0.1:0", 3000, []byte("secret"), &config)
+	startServer(t, server)
+
+	client, _ := NewAuthClient(31337, []byte("secret"))
+	client.Retries = 1
+	if _, err := client.Verify(addrLocal(server.Addr())); err == nil {
+		t.Errorf("Expected an error without LegacyKDF, got nil")
+	}
+	client.LegacyKDF = true
+	if _, err := client.Verify(addrLocal(server.Addr())); err != nil {
+		t.Errorf("auth with LegacyKDF: %v", err)
+	}
+	server.Close()
+}
+
+func TestSilentCandidate(t *testing.T) {
+	// a candidate that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var received atomic.Int32
+	go func() {
+		buf := make([]byte, LEN_UDP_BUF)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	client, _ := NewAuthClient(31337, []byte("secret"))
+	client.Timeout = 20
+	if _, err := client.Verify(conn.LocalAddr().String()); err != ERR_DID_NOT_RESPOND {
+		t.Fatalf("Wanted %v, got %v", ERR_DID_NOT_RESPOND, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	sent := received.Load()
+	if want := int32(2 * client.Retries); sent != want {
+		t.Errorf("Wanted %d challenges, got %d", want, sent)
+	}
+
+	// it is skipped for a while
+	if _, err := client.Verify(conn.LocalAddr().String()); err != ERR_DID_NOT_RESPOND {
+		t.Errorf("Wanted %v, got %v", ERR_DID_NOT_RESPOND, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if received.Load() != sent {
+		t.Errorf("Silent candidate tried again")
+	}
+}
+
+func TestAuthMetadata(t *testing.T) {
+	metadata := map[string]string{"version": "1.2", "zone": "eu-1", "role": ""}
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, []byte("secret"))
+	if err := server.SetMetadata(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetMetadata(map[string]string{"big": strings.Repeat("x", MAX_METADATA_LEN)}); err == nil {
+		t.Errorf("Expected an error for too much metadata, got nil")
+	}
+	endpoints := []Endpoint{{Name: "http", Protocol: "tcp", Port: 8080}, {Name: "dns", Protocol: "udp", Port: 53, Host: "ns.example.com"}}
+	if err := server.SetEndpoints(endpoints); err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, server)
+
+	client, _ := NewAuthClient(31337, []byte("secret"))
+	response, err := client.Verify(addrLocal(server.Addr()))
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if !reflect.DeepEqual(response.Metadata, metadata) {
+		t.Errorf("Wanted metadata %v, got %v", metadata, response.Metadata)
+	}
+	if !reflect.DeepEqual(response.Endpoints, endpoints) {
+		t.Errorf("Wanted endpoints %v, got %v", endpoints, response.Endpoints)
+	}
+
+	// the metadata is authenticated
+	keys, _ := deriveKeys([]byte("secret"), DEFAULT_KDF)
+	challenge, _ := NewChallenge()
+	challenge.KeyHint = keys.hint
+	challenge.KDF = keys.version
+	challenge.Flags = FLAG_METADATA | FLAG_ENDPOINTS
+	response = &Response{}
+	if err := server.respondChallenge(challenge, response); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := response.ToBuffer()
+	if _, ok := challenge.VerifyResponse(bytes.NewBuffer(buf.Bytes()), nil, keys.mac); !ok {
+		t.Errorf("Response not verified")
+	}
+	for _, field := range []string{"eu-1", "ns.example.com"} {
+		tampered := bytes.Replace(buf.Bytes(), []byte(field), []byte(strings.ToUpper(field)), 1)
+		if _, ok := challenge.VerifyResponse(bytes.NewBuffer(tampered), nil, keys.mac); ok {
+			t.Errorf("Tampered response verified")
+		}
+	}
+
+	// older clients don't get any
+	challenge.Flags = 0
+	response = &Response{}
+	server.respondChallenge(challenge, response)
+	if buf, _ := response.ToBuffer(); buf.Len() != 34 {
+		t.Errorf("Wanted a 34 bytes response, got %d", buf.Len())
+	}
+	server.Close()
+}
+
+func TestAuthMutual(t *testing.T) {
+	allowSelf(t)
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, []byte("secret"))
+	keys, _ := deriveKeys([]byte("secret"), DEFAULT_KDF)
+	challenge, _ := NewChallenge()
+	challenge.KeyHint = keys.hint
+	challenge.KDF = keys.version
+	challengeBuf, _ := challenge.ToBuffer()
+
+	// one-shot challenges are not answered
+	if _, _, err := server.handleMessage("192.0.2.1:1000", challengeBuf.Bytes()); err != ERR_NOT_MUTUAL {
+		t.Errorf("Wanted ERR_NOT_MUTUAL, got %v", err)
+	}
+
+	// nor are challenges for unknown passphrases
+	other, _ := deriveKeys([]byte("other"), DEFAULT_KDF)
+	unknown := *challenge
+	unknown.KeyHint = other.hint
+	unknown.Flags = FLAG_MUTUAL
+	unknownBuf, _ := unknown.ToBuffer()
+	if _, _, err := server.handleMessage("192.0.2.1:1000", unknownBuf.Bytes()); err != ERR_UNKNOWN_KEY {
+		t.Errorf("Wanted ERR_UNKNOWN_KEY, got %v", err)
+	}
+
+	challenge.Flags = FLAG_MUTUAL
+	challengeBuf, _ = challenge.ToBuffer()
+	reply, final, err := server.handleMessage("192.0.2.1:1000", challengeBuf.Bytes())
+	if err != nil || final {
+		t.Fatalf("Wanted a nonce, got %v", err)
+	}
+	nonce, err := parseNonce(reply)
+	if err != nil || nonce.Challenge != challenge.Challenge {
+		t.Fatalf("Invalid nonce: %v", err)
+	}
+
+	// the proof must come from the same address, and with the right key
+	proofBuf, _ := challenge.NewProof(nonce, keys.mac).ToBuffer()
+	if _, _, err := server.handleMessage("192.0.2.2:1000", proofBuf.Bytes()); err != ERR_BAD_NONCE {
+		t.Errorf("Wanted ERR_BAD_NONCE, got %v", err)
+	}
+	forgedBuf, _ := challenge.NewProof(nonce, other.mac).ToBuffer()
+	if _, _, err := server.handleMessage("192.0.2.1:1000", forgedBuf.Bytes()); err != ERR_DID_NOT_VERIFY {
+		t.Errorf("Wanted ERR_DID_NOT_VERIFY, got %v", err)
+	}
+	reply, final, err = server.handleMessage("192.0.2.1:1000", proofBuf.Bytes())
+	if err != nil || !final {
+		t.Fatalf("Wanted a response, got %v", err)
+	}
+	if response, ok := challenge.VerifyResponse(bytes.NewBuffer(reply), nonce, keys.mac); !ok || response.Port != 3000 {
+		t.Errorf("Response not verified")
+	}
+
+	// the MAC covers the port, the nonce and the node IDs
+	tampered := bytes.Clone(reply)
+	tampered[0]++
+	if _, ok := challenge.VerifyResponse(bytes.NewBuffer(tampered), nonce, keys.mac); ok {
+		t.Errorf("Response with another port verified")
+	}
+	if _, ok := challenge.VerifyResponse(bytes.NewBuffer(reply), nil, keys.mac); ok {
+		t.Errorf("Response verified without the transcript")
+	}
+	relayed := *nonce
+	relayed.Dedupe[0]++
+	if _, ok := challenge.VerifyResponse(bytes.NewBuffer(reply), &relayed, keys.mac); ok {
+		t.Errorf("Response verified with another node ID")
+	}
+
+	// with LegacyAuth, one-shot challenges are answered
+	server.legacyAuth = true
+	challenge.Flags = 0
+	challengeBuf, _ = challenge.ToBuffer()
+	if _, final, err := server.handleMessage("192.0.2.1:1000", challengeBuf.Bytes()); err != nil || !final {
+		t.Errorf("Wanted a response, got %v", err)
+	}
 }
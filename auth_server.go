@@ -2,80 +2,351 @@ package discover
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"github.com/oxtoacart/bpool"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oxtoacart/bpool"
+	"golang.org/x/net/ipv6"
 )
 
 ///////////////////////////////////////////////////////////////////////
 // authentication server
 ///////////////////////////////////////////////////////////////////////
 
+// The server answers challenges for the passphrase and application port it
+// was created with, and for any other added with AddKey. The key hint in the
+// challenge selects which one is used, and the keys are derived with the
+// scheme of the challenge, if it is one we use (see Config.KDF).
 type AuthServer struct {
 	AppPort    int
 	Passphrase []byte
+	// If set, the responses to FLAG_IDENTITY are signed with this key.
+	Identity ed25519.PrivateKey
+	// If set, it is called with the address of every client that completes
+	// a mutual or a Noise handshake, and the session shared with it. It is
+	// called by the handlers, so it must not block.
+	OnSession func(addr string, session *Session)
 
-	address string
+	kdf        byte
+	legacyKDF  bool
+	legacyAuth bool // if true, one-shot challenges are answered
+	noise      bool // if true, only Noise handshakes are answered
+
+	keysMu   sync.RWMutex
+	keys     map[keyID]serverKey // other passphrases
+	sections map[byte][]byte     // response sections for our main passphrase, by flag
+
+	address  string
+	ipv4Only bool // if true, we listen with tcp4 and udp4
 
 	tcpListener net.Listener
 	udpListener *net.UDPConn
+	mcListeners []*net.UDPConn // multicast groups joined with JoinMulticast
 
 	udpPool *bpool.BytePool // a pool of buffers for reqding UDP requests
 	// see also github.com/oxtoacart/bpool
+
+	timeout time.Duration // for TCP clients
+	logger  *slog.Logger
+	metrics *metrics
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup // listeners and in-flight handlers
+}
+
+// A passphrase the server can answer challenges for.
+type serverKey struct {
+	keys     *keySet
+	appPort  int
+	sections map[byte][]byte // response sections, by flag
+}
+
+// Identifies a passphrase in the challenges.
+type keyID struct {
+	hint [LEN_KEY_HINT]byte
+	kdf  byte
 }
 
 // creates a new authentication server/client
 func NewAuthServer(address string, appPort int, passphrase []byte) (*AuthServer, error) {
+	config := DefaultConfig()
+	return newAuthServer(address, appPort, passphrase, &config), nil
+}
+
+// creates a new authentication server, with the buffers, timeouts and logger
+// in config
+func newAuthServer(address string, appPort int, passphrase []byte, config *Config) *AuthServer {
 	// create a pool of buffers that we will use for reading from UDP
-	pool := bpool.NewBytePool(LEN_UDP_POOLS, LEN_UDP_BUF)
+	pool := bpool.NewBytePool(config.UDPPoolSize, config.UDPBufferSize)
 
 	return &AuthServer{
 		AppPort:    appPort,
 		Passphrase: passphrase,
 		address:    address,
+		ipv4Only:   config.AuthIPv4Only,
+		kdf:        config.KDF,
+		legacyKDF:  config.LegacyKDF,
+		legacyAuth: config.LegacyAuth,
+		noise:      config.Noise,
+		Identity:   config.Identity,
+		OnSession:  config.OnSession,
+		keys:       make(map[keyID]serverKey),
 		udpPool:    pool,
-	}, nil
+		timeout:    config.VerifyTimeout,
+		logger:     config.Logger,
+		metrics:    newMetrics(),
+	}
+}
+
+// AddKey makes the server answer the challenges for another passphrase,
+// advertising appPort as the application port.
+func (a *AuthServer) AddKey(passphrase []byte, appPort int) error {
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	added := make(map[keyID]serverKey)
+	for _, version := range kdfVersions(a.kdf, a.legacyKDF) {
+		keys, err := deriveKeys(passphrase, version)
+		if err != nil {
+			return err
+		}
+		main, err := deriveKeys(a.Passphrase, version)
+		if err != nil {
+			return err
+		}
+		id := keyID{hint: keys.hint, kdf: version}
+		if _, found := a.keys[id]; found || keys.hint == main.hint {
+			return fmt.Errorf("passphrase already registered or key hint collision")
+		}
+		added[id] = serverKey{keys: keys, appPort: appPort}
+	}
+	for id, key := range added {
+		a.keys[id] = key
+	}
+	return nil
+}
+
+// SetMetadata sets the metadata sent with the responses for our passphrase.
+func (a *AuthServer) SetMetadata(metadata map[string]string) error {
+	section, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	return a.setSection(nil, FLAG_METADATA, section)
+}
+
+// SetKeyMetadata sets the metadata sent with the responses for a passphrase
+// added with AddKey.
+func (a *AuthServer) SetKeyMetadata(passphrase []byte, metadata map[string]string) error {
+	section, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	return a.setSection(passphrase, FLAG_METADATA, section)
+}
+
+// SetEndpoints sets the endpoints advertised with the responses for our
+// passphrase.
+func (a *AuthServer) SetEndpoints(endpoints []Endpoint) error {
+	section, err := encodeEndpoints(endpoints)
+	if err != nil {
+		return err
+	}
+	return a.setSection(nil, FLAG_ENDPOINTS, section)
+}
+
+// SetKeyEndpoints sets the endpoints advertised with the responses for a
+// passphrase added with AddKey.
+func (a *AuthServer) SetKeyEndpoints(passphrase []byte, endpoints []Endpoint) error {
+	section, err := encodeEndpoints(endpoints)
+	if err != nil {
+		return err
+	}
+	return a.setSection(passphrase, FLAG_ENDPOINTS, section)
+}
+
+// SetHosts sets the hosts (IP addresses or DNS names) where our application
+// can be reached, for when the address our challenges are answered from is
+// not the right one, e.g. behind a load balancer. Clients prefer them, in
+// order, to the address they see.
+func (a *AuthServer) SetHosts(hosts []string) error {
+	section, err := encodeHosts(hosts)
+	if err != nil {
+		return err
+	}
+	return a.setSection(nil, FLAG_HOSTS, section)
+}
+
+// SetKeyHosts sets the hosts advertised with the responses for a passphrase
+// added with AddKey.
+func (a *AuthServer) SetKeyHosts(passphrase []byte, hosts []string) error {
+	section, err := encodeHosts(hosts)
+	if err != nil {
+		return err
+	}
+	return a.setSection(passphrase, FLAG_HOSTS, section)
+}
+
+// sets a response section for a passphrase added with AddKey, or for our main
+// passphrase if passphrase is nil. The maps of sections are never modified,
+// as they are used without holding keysMu.
+func (a *AuthServer) setSection(passphrase []byte, flag byte, section []byte) error {
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	if passphrase == nil {
+		a.sections = withSection(a.sections, flag, section)
+		return nil
+	}
+	for _, version := range kdfVersions(a.kdf, a.legacyKDF) {
+		keys, err := deriveKeys(passphrase, version)
+		if err != nil {
+			return err
+		}
+		id := keyID{hint: keys.hint, kdf: version}
+		key, found := a.keys[id]
+		if !found {
+			return fmt.Errorf("unknown passphrase")
+		}
+		key.sections = withSection(key.sections, flag, section)
+		a.keys[id] = key
+	}
+	return nil
+}
+
+// returns the key for a key hint and derivation scheme. Challenges without
+// hint are answered with our main passphrase.
+func (a *AuthServer) lookupKey(hint [LEN_KEY_HINT]byte, kdf byte) (serverKey, error) {
+	accepted := false
+	for _, version := range kdfVersions(a.kdf, a.legacyKDF) {
+		accepted = accepted || version == kdf
+	}
+	if !accepted {
+		return serverKey{}, ERR_UNKNOWN_KEY
+	}
+
+	main, err := deriveKeys(a.Passphrase, kdf)
+	if err != nil {
+		return serverKey{}, err
+	}
+	if (hint == [LEN_KEY_HINT]byte{} && kdf == KDF_LEGACY) || hint == main.hint {
+		if a.AppPort <= 0 {
+			return serverKey{}, ERR_UNKNOWN_KEY
+		}
+		a.keysMu.RLock()
+		defer a.keysMu.RUnlock()
+		return serverKey{keys: main, appPort: a.AppPort, sections: a.sections}, nil
+	}
+	a.keysMu.RLock()
+	defer a.keysMu.RUnlock()
+	if key, found := a.keys[keyID{hint: hint, kdf: kdf}]; found && key.appPort > 0 {
+		return key, nil
+	}
+	return serverKey{}, ERR_UNKNOWN_KEY
 }
 
 // start listening for TCP and UDP authentication requests
-// this method can only be invoked once
+// this method can only be invoked once, and never after Close
 func (a *AuthServer) ListenAndServe() error {
+	if a.isClosed() {
+		return ERR_SERVER_CLOSED
+	}
 	if err := a.listenAndServeTCP(); err != nil {
 		return err
 	}
 	if err := a.listenAndServeUDP(); err != nil {
-		// TODO: send a message to the TCP listener for closing the connection
+		a.Close()
 		return err
 	}
 	return nil
 }
 
+// Addr returns the address the server is listening on, or nil if it is not
+// listening.
+func (a *AuthServer) Addr() net.Addr {
+	if a.udpListener == nil {
+		return nil
+	}
+	return a.udpListener.LocalAddr()
+}
+
+// Close stops the TCP and UDP listeners and waits for the requests being
+// handled to finish. It is safe to call Close more than once.
+func (a *AuthServer) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	var err error
+	if a.tcpListener != nil {
+		if cErr := a.tcpListener.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	if a.udpListener != nil {
+		if cErr := a.udpListener.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	a.mu.Lock()
+	for _, listener := range a.mcListeners {
+		listener.Close()
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+	return err
+}
+
 //////////////////////////
 // private methods
 //////////////////////////
 
+// returns the network to listen on for proto ("tcp" or "udp"). Without the
+// version, listening on 0.0.0.0 accepts IPv6 clients too.
+func (a *AuthServer) network(proto string) string {
+	if a.ipv4Only {
+		return proto + "4"
+	}
+	return proto
+}
+
 // listen for TCP connections
 func (a *AuthServer) listenAndServeTCP() error {
-	if tcpaddr, err := net.ResolveTCPAddr("tcp", a.address); err != nil {
+	if tcpaddr, err := net.ResolveTCPAddr(a.network("tcp"), a.address); err != nil {
 		return fmt.Errorf("could not resolve TCP address %s: %v", a.address, err)
 	} else {
-		log.Printf("Creating authentication TCP listeners on %s...", a.address)
-		if tcpListener, err := net.ListenTCP("tcp", tcpaddr); err != nil {
+		a.logger.Info("creating authentication TCP listener", "stage", "listen", "addr", a.address)
+		if tcpListener, err := net.ListenTCP(a.network("tcp"), tcpaddr); err != nil {
 			return fmt.Errorf("could not listen on TCP address %s: %v", a.address, err)
 		} else {
 			a.tcpListener = tcpListener
+			// when listening on port 0, use the same port for UDP
+			a.address = tcpListener.Addr().String()
 
+			a.wg.Add(1)
 			go func() {
+				defer a.wg.Done()
 				defer a.tcpListener.Close()
 				for {
 					if conn, aErr := a.tcpListener.Accept(); aErr != nil {
-						log.Println("TCP accept error. Stopping TCP listener:", aErr)
+						if !a.isClosed() {
+							a.logger.Error("TCP accept error, stopping the TCP listener", "stage", "listen", "err", aErr)
+						}
 						return
 					} else {
+						a.wg.Add(1)
 						go a.handleTCPClient(&conn)
 					}
 				}
@@ -87,102 +358,352 @@ func (a *AuthServer) listenAndServeTCP() error {
 }
 
 func (a *AuthServer) handleTCPClient(conn *net.Conn) {
-	// Everything is done with one packet in and one packet out, so close
-	// the connection after this function ends.
+	defer a.wg.Done()
+	// Everything is done with one packet in and one packet out, or two with
+	// FLAG_MUTUAL, so close the connection after this function ends.
 	defer (*conn).Close()
+	(*conn).SetDeadline(time.Now().Add(a.timeout))
+
+	peer := (*conn).RemoteAddr().String()
+	buf := make([]byte, LEN_UDP_MIN_BUF)
+	for final, afterNonce := false, false; !final; afterNonce = true {
+		msg, err := readTCPMessage(*conn, buf, afterNonce)
+		if err != nil {
+			return
+		}
+		var reply []byte
+		reply, final, err = a.handleMessage(peer, msg)
+		if err != nil {
+			a.logger.Debug("challenge rejected", "stage", "challenge", "peer", peer, "kind", errorKind(err))
+			return
+		}
+		if _, err = (*conn).Write(reply); err != nil {
+			a.logger.Debug("could not send the response", "stage", "challenge", "peer", peer, "err", err)
+			return
+		}
+	}
+}
 
-	// Parse the incoming packet.
-	challenge := new(Challenge)
-	err := binary.Read(*conn, binary.LittleEndian, challenge)
+// reads the next message of a TCP client into buf. The stream has no message
+// boundaries: v2 frames are read field by field until they have every field
+// of their message, and v1 messages by their size, a proof after a nonce and
+// otherwise a challenge. Older nodes sent shorter challenges in one write, so
+// what comes with the first LEN_CHALLENGE_V1 bytes is taken as a challenge if
+// it has the size of one of theirs.
+func readTCPMessage(r io.Reader, buf []byte, afterNonce bool) ([]byte, error) {
+	n, err := io.ReadFull(r, buf[:len(frameHeader)+1])
 	if err != nil {
-		return
+		return nil, err
 	}
-	response := Response{Port: uint16(a.AppPort)}
-	a.respondChallenge(challenge, response)
-	if err = binary.Write(*conn, binary.LittleEndian, response); err != nil {
-		return
+	if isFrame(buf[:n]) {
+		missing := slices.Clone(requestFields[buf[len(frameHeader)]])
+		for len(missing) > 0 {
+			if n+3 > len(buf) {
+				return nil, ERR_IS_NOT_PEER
+			}
+			if _, err := io.ReadFull(r, buf[n:n+3]); err != nil {
+				return nil, err
+			}
+			typ, size := buf[n], int(binary.LittleEndian.Uint16(buf[n+1:]))
+			n += 3
+			if n+size > len(buf) {
+				return nil, ERR_IS_NOT_PEER
+			}
+			if _, err := io.ReadFull(r, buf[n:n+size]); err != nil {
+				return nil, err
+			}
+			n += size
+			missing = slices.DeleteFunc(missing, func(t byte) bool { return t == typ })
+		}
+		return buf[:n], nil
+	}
+
+	if afterNonce {
+		if _, err := io.ReadFull(r, buf[n:LEN_PROOF]); err != nil {
+			return nil, err
+		}
+		return buf[:LEN_PROOF], nil
+	}
+	m, err := io.ReadAtLeast(r, buf[n:LEN_CHALLENGE], LEN_CHALLENGE_V1-n)
+	if err != nil {
+		return nil, err
+	}
+	switch n += m; n {
+	case LEN_CHALLENGE_V1, LEN_CHALLENGE_V2, LEN_CHALLENGE_V3, LEN_CHALLENGE:
+		return buf[:n], nil
 	}
+	if _, err := io.ReadFull(r, buf[n:LEN_CHALLENGE]); err != nil {
+		return nil, err
+	}
+	return buf[:LEN_CHALLENGE], nil
 }
 
 // listen for UDP connections
 func (a *AuthServer) listenAndServeUDP() error {
-	if udpaddr, err := net.ResolveUDPAddr("udp", a.address); err != nil {
+	if udpaddr, err := net.ResolveUDPAddr(a.network("udp"), a.address); err != nil {
 		return fmt.Errorf("could not resolve UDP address %s: %v", a.address, err)
 	} else {
-		log.Printf("Creating authentication UDP listeners on %s...", a.address)
+		a.logger.Info("creating authentication UDP listener", "stage", "listen", "addr", a.address)
 
-		if udpListener, err := net.ListenUDP("udp", udpaddr); err != nil {
+		if udpListener, err := net.ListenUDP(a.network("udp"), udpaddr); err != nil {
 			// TODO: send a message to the TCP listener for closing the connection
 			return fmt.Errorf("could not listen on UDP address %s: %v", a.address, err)
 		} else {
 			a.udpListener = udpListener
 
-			go func(listener *net.UDPConn) {
-				defer listener.Close()
+			a.wg.Add(1)
+			go a.serveUDP(a.udpListener)
+		}
+	}
 
-				for {
-					log.Printf("Reading from UDP socket...")
-					buf := a.udpPool.Get()
-					n, addr, uErr := listener.ReadFromUDP(buf)
-					log.Printf("READ: %d", n)
-					// TODO: control return values
-					if uErr != nil {
-						log.Println("UDP accept error. Stopping UDP listener:", uErr)
-						a.udpPool.Put(buf)
-						return
-					} else if n > 0 {
-						go a.handleUDPClient(addr, buf)
-					} else {
-						log.Printf("could not read from UDP socket: len=%d", n)
-						a.udpPool.Put(buf)
-					}
+	return nil
+}
 
-				}
-			}(a.udpListener)
+// JoinMulticast makes the server answer the challenges sent to an IPv6
+// multicast group (on our port), on every interface that supports
+// multicast. It must be called after ListenAndServe.
+//
+// When the server listens on all the addresses, the group is joined by its
+// UDP listener, as no other socket can bind its port. Otherwise a socket is
+// opened for the group on every interface.
+func (a *AuthServer) JoinMulticast(group string) error {
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() {
+		return fmt.Errorf("invalid multicast group %s", group)
+	}
+	if a.udpListener == nil {
+		return fmt.Errorf("the server is not listening")
+	}
+	port := a.udpListener.LocalAddr().(*net.UDPAddr).Port
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return fmt.Errorf("the server is closed")
+	}
+	local := a.udpListener.LocalAddr().(*net.UDPAddr).IP
+	shared := local.IsUnspecified() && local.To4() == nil
+	conn := ipv6.NewPacketConn(a.udpListener)
+	joined := 0
+	ifaces := multicastInterfaces()
+	for i := range ifaces {
+		iface := &ifaces[i]
+		var err error
+		if shared {
+			err = conn.JoinGroup(iface, &net.UDPAddr{IP: ip})
+		} else {
+			var listener *net.UDPConn
+			if listener, err = net.ListenMulticastUDP("udp6", iface, &net.UDPAddr{IP: ip, Port: port}); err == nil {
+				a.mcListeners = append(a.mcListeners, listener)
+				a.wg.Add(1)
+				go a.serveUDP(listener)
+			}
+		}
+		if err != nil {
+			a.logger.Warn("could not join multicast group", "stage", "listen", "group", group, "iface", iface.Name, "err", err)
+		} else {
+			a.logger.Info("joined multicast group", "stage", "listen", "group", group, "iface", iface.Name)
+			joined++
 		}
 	}
-
+	if joined == 0 {
+		return fmt.Errorf("could not join multicast group %s on any interface", group)
+	}
 	return nil
 }
 
+// reads challenges from a UDP socket until it is closed
+func (a *AuthServer) serveUDP(listener *net.UDPConn) {
+	defer a.wg.Done()
+	defer listener.Close()
+
+	for {
+		buf := a.udpPool.Get()
+		n, addr, uErr := listener.ReadFromUDP(buf)
+		// TODO: control return values
+		if uErr != nil {
+			if !a.isClosed() {
+				a.logger.Error("UDP read error, stopping the UDP listener", "stage", "listen", "err", uErr)
+			}
+			a.udpPool.Put(buf)
+			return
+		} else if n > 0 {
+			a.wg.Add(1)
+			go a.handleUDPClient(listener, addr, buf, n)
+		} else {
+			a.logger.Debug("empty UDP packet", "stage", "challenge", "peer", addr)
+			a.udpPool.Put(buf)
+		}
+	}
+}
+
 // Handle an UDP client
-func (a *AuthServer) handleUDPClient(addr *net.UDPAddr, bufPool []byte) {
+func (a *AuthServer) handleUDPClient(listener *net.UDPConn, addr *net.UDPAddr, bufPool []byte, n int) {
+	defer a.wg.Done()
 	defer a.udpPool.Put(bufPool)
 
-	buf := bytes.NewBuffer(bufPool)
-
-	// Parse the incoming packet.
-	challenge := new(Challenge)
-	err := binary.Read(buf, binary.LittleEndian, challenge)
+	reply, _, err := a.handleMessage(addr.String(), bufPool[:n])
 	if err != nil {
+		a.logger.Debug("challenge rejected", "stage", "challenge", "peer", addr, "len", n, "kind", errorKind(err))
 		return
 	}
-	response := Response{Port: uint16(a.AppPort)}
+	listener.WriteToUDP(reply, addr)
+	// TODO: control partial writes/errors
 
-	a.respondChallenge(challenge, response)
+}
 
-	wbuf := new(bytes.Buffer)
-	if err = binary.Write(wbuf, binary.LittleEndian, response); err != nil {
-		log.Println("failed to write to remote peer:", err)
-		return
+// returns true once Close has been called
+func (a *AuthServer) isClosed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+// handles a challenge or a proof sent from addr, with either framing, or the
+// start of a Noise handshake, and returns what is sent back: a nonce, or a
+// response if final is true.
+func (a *AuthServer) handleMessage(addr string, buf []byte) (reply []byte, final bool, err error) {
+	if isNoiseFrame(buf) {
+		reply, final, err = a.respondNoise(addr, buf)
+		// cookies are not answers yet
+		if err != nil || final {
+			a.metrics.challenge(err)
+		}
+		return reply, final, err
+	} else if a.noise {
+		a.metrics.challenge(ERR_NOISE_REQUIRED)
+		return nil, false, ERR_NOISE_REQUIRED
 	}
-	a.udpListener.WriteToUDP(wbuf.Bytes(), addr)
-	// TODO: control partial writes/errors
 
+	var challenge *Challenge
+	var proof *Proof
+	version := byte(WIRE_V1)
+	if isFrame(buf) {
+		version = WIRE_V2
+		challenge, proof, err = parseRequestFrame(buf)
+	} else if len(buf) == LEN_PROOF {
+		proof, err = parseProof(buf)
+	} else {
+		challenge, err = parseChallenge(buf)
+	}
+
+	var msg message
+	if err != nil {
+		// not a request
+	} else if proof != nil {
+		response := new(Response)
+		err = a.respondProof(addr, proof, response)
+		msg, final = response, true
+	} else if challenge.Flags&FLAG_MUTUAL != 0 {
+		msg, err = a.respondNonce(addr, challenge)
+	} else if !a.legacyAuth {
+		err = ERR_NOT_MUTUAL
+	} else {
+		response := new(Response)
+		err = a.respondChallenge(challenge, response)
+		msg, final = response, true
+	}
+	if err == nil {
+		reply, err = encodeMessage(msg, version)
+	}
+	// nonces are not answers yet
+	if err != nil || final {
+		a.metrics.challenge(err)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return reply, final, nil
+}
+
+// answers a challenge with FLAG_MUTUAL sent from addr with a nonce, if we know
+// the passphrase it is for
+func (a *AuthServer) respondNonce(addr string, challenge *Challenge) (*Nonce, error) {
+	if err := checkChallenge(challenge); err != nil {
+		return nil, err
+	}
+	// the zero hint of older clients would select our main passphrase
+	if challenge.KeyHint == [LEN_KEY_HINT]byte{} {
+		return nil, ERR_UNKNOWN_KEY
+	}
+	if _, err := a.lookupKey(challenge.KeyHint, challenge.KDF); err != nil {
+		return nil, err
+	}
+	return newNonce(challenge, makeNonce(addr, challenge, time.Now())), nil
+}
+
+// returns the nonce message for a challenge
+func newNonce(challenge *Challenge, value [LEN_NONCE]byte) *Nonce {
+	nonce := &Nonce{Challenge: challenge.Challenge, Nonce: value}
+	copy(nonce.MagicHeader[:], magicHeader)
+	copy(nonce.Dedupe[:], dedupe)
+	return nonce
+}
+
+// answers a proof sent from addr, if the nonce is one we sent it recently and
+// the client knows the passphrase
+func (a *AuthServer) respondProof(addr string, proof *Proof, response *Response) error {
+	challenge := &proof.Challenge
+	if err := checkChallenge(challenge); err != nil {
+		return err
+	}
+	now := time.Now()
+	if challenge.Flags&FLAG_MUTUAL == 0 || challenge.KeyHint == [LEN_KEY_HINT]byte{} ||
+		(proof.Nonce != makeNonce(addr, challenge, now) &&
+			proof.Nonce != makeNonce(addr, challenge, now.Add(-NONCE_LIFETIME))) {
+		return ERR_BAD_NONCE
+	}
+	key, err := a.lookupKey(challenge.KeyHint, challenge.KDF)
+	if err != nil {
+		return err
+	}
+	nonce := newNonce(challenge, proof.Nonce)
+	if !hmac.Equal(proof.MAC[:], transcriptMAC(key.keys.mac, "discover proof", transcript(challenge, nonce))) {
+		return ERR_DID_NOT_VERIFY
+	}
+	respond(key, a.Identity, challenge, nonce, response)
+	if a.OnSession != nil {
+		a.OnSession(addr, newSession(key.keys.enc, transcript(challenge, nonce)))
+	}
+	return nil
+}
+
+// returns the nonce for a challenge from addr, at the given time
+func makeNonce(addr string, challenge *Challenge, at time.Time) (nonce [LEN_NONCE]byte) {
+	mac := hmac.New(sha256.New, nonceKey)
+	binary.Write(mac, binary.LittleEndian, at.UnixNano()/int64(NONCE_LIFETIME))
+	mac.Write([]byte(addr))
+	binary.Write(mac, binary.LittleEndian, challenge)
+	copy(nonce[:], mac.Sum(nil))
+	return nonce
+}
+
+// answers a one-shot challenge, without FLAG_MUTUAL
+func (a *AuthServer) respondChallenge(challenge *Challenge, response *Response) error {
+	if err := checkChallenge(challenge); err != nil {
+		return err
+	}
+
+	// Select the passphrase the client is asking for.
+	key, err := a.lookupKey(challenge.KeyHint, challenge.KDF)
+	if err != nil {
+		return err
+	}
+	respond(key, a.Identity, challenge, nil, response)
+	return nil
 }
 
-func (a *AuthServer) respondChallenge(challenge *Challenge, response Response) error {
+// returns an error if the challenge is not from a peer, or from ourselves
+func checkChallenge(challenge *Challenge) error {
 	// Verify if the magic header is correct. Several DHT nodes will connect
 	// to whatever peer they believe exist, most likely to scrape their
 	// content. But we're not BitTorrent clients, so we just close the
 	// connection. This shouldn't cause damage to the network because we're
 	// not pretending to be peers for a bittorrent infohash. So these
 	// spurious incoming connections are from misbehaving clients.
-	if !bytes.Equal(challenge.MagicHeader[:], magicHeader) {
+	if !bytes.Equal(challenge.MagicHeader[:], magicHeader[:len(challenge.MagicHeader)]) {
 		// Not a wherez peer.
-		log.Print("magic does not match: not a peer")
-		return nil
+		return ERR_BAD_MAGIC
 	}
 
 	// dedupe is a small byte array generated on initialization that
@@ -194,15 +715,27 @@ func (a *AuthServer) respondChallenge(challenge *Challenge, response Response) e
 	// seem worth it.
 	if !allowSelfConnection && bytes.Equal(challenge.Dedupe[:], dedupe) {
 		// Connection to self. Closing.
-		log.Print("self-connecting")
-		return nil
+		return ERR_SELF_CONNECTION
 	}
+	return nil
+}
 
+// fills the response to a challenge, with a key, signed with identity if it is
+// not nil. The nonce is the one of a mutual handshake, or nil for one-shot
+// challenges.
+func respond(key serverKey, identity ed25519.PrivateKey, challenge *Challenge, nonce *Nonce, response *Response) {
 	// Calculate the challenge response.
-	mac := hmac.New(sha256.New, a.Passphrase)
-	mac.Write(challenge.Challenge[:])
+	response.Port = uint16(key.appPort)
+	response.sections = appendSections(key, identity, challenge.Flags, response.Port, responseBinding(challenge, nonce))
+	copy(response.MAC[:], response.mac(challenge, nonce, key.keys.mac, response.sections))
+}
 
-	// Create the response packet.
-	copy(response.MAC[:], mac.Sum(nil))
-	return nil
+// returns a copy of sections, with section set for flag
+func withSection(sections map[byte][]byte, flag byte, section []byte) map[byte][]byte {
+	updated := make(map[byte][]byte, len(sections)+1)
+	for f, s := range sections {
+		updated[f] = s
+	}
+	updated[flag] = section
+	return updated
 }
@@ -0,0 +1,60 @@
+package discover
+
+import (
+	"context"
+	"log/slog"
+)
+
+///////////////////////////////////////////////////////////////////////
+// discovery backends
+///////////////////////////////////////////////////////////////////////
+
+// A possible peer of a service, found by a backend. It is not reported to
+// the application until it has been verified.
+type Candidate struct {
+	Service *Service
+	Addr    string // address where the candidate should answer challenges
+	Source  string // name of the backend that found it
+}
+
+// A Backend is a source of candidate peers: the Mainline DHT, a static list
+// of addresses, the local network, etc. A Discoverer can use several
+// backends at the same time; the candidates from all of them are merged,
+// deduplicated and verified with the AuthClient.
+type Backend interface {
+	// Name identifies the backend in logs and candidates.
+	Name() string
+
+	// Start starts announcing ourselves for the announced services and sends
+	// the candidates found for any of the services to candidates, until ctx
+	// is cancelled.
+	Start(ctx context.Context, services []*Service, candidates chan<- Candidate) error
+
+	// Lookup asks the backend to look for candidates of a service now. It is
+	// called periodically, following the discoverer's query schedule, and
+	// must not block.
+	Lookup(s *Service)
+
+	// Stop releases the resources of the backend. It is called after ctx has
+	// been cancelled.
+	Stop() error
+}
+
+// Backends that need our AuthServer to answer challenges sent to multicast
+// groups.
+type multicastBackend interface {
+	multicastGroups() []string
+}
+
+// Backends that log through the discoverer's logger.
+type loggingBackend interface {
+	setLogger(logger *slog.Logger)
+}
+
+// sends a candidate, unless ctx is cancelled
+func sendCandidate(ctx context.Context, candidates chan<- Candidate, c Candidate) {
+	select {
+	case candidates <- c:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,326 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nictuku/dht"
+)
+
+const DEFAULT_DHT_NODE = "213.239.195.138:40000"
+
+// Name of the endpoint with the port of our DHT node, advertised when it is
+// not the one after our authentication port (see Config.DHTPort).
+const DHT_ENDPOINT = "discover-dht"
+
+// A DHTBackend finds candidates in the BitTorrent Mainline DHT, where
+// peers announce themselves under the infohash of each service. It runs an
+// IPv4 node and, unless disabled, an IPv6 node (BEP 32) on the same port.
+//
+// The DHT is joined through the BootstrapNodes (host:port, where host can be
+// a DNS name), tried in order, and nothing else: the routers built into the
+// DHT library are not used. When none of them is reachable, previously
+// verified peers and nodes that answered before are used instead. The
+// bootstrap is repeated when the DHT stops giving results.
+type DHTBackend struct {
+	port int
+
+	// Address the DHT nodes listen on, all by default.
+	Address string
+	// Port announced in the DHT: the port of our AuthServer. If 0, the DHT
+	// port is announced.
+	AnnouncePort int
+	// If false, we only join the IPv4 DHT.
+	IPv6 bool
+
+	BootstrapNodes []string
+
+	nodes      []string    // good nodes from a previous run
+	contacts   dhtContacts // DHT nodes that queried ours
+	dhts       []*dhtNode  // one per IP version
+	chain      *bootstrapChain
+	services   []*Service
+	lastResult time.Time
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	logger     *slog.Logger
+}
+
+// A DHT node for one of the IP versions.
+type dhtNode struct {
+	proto string // "udp4" or "udp6"
+	*dht.DHT
+}
+
+// The DHT library does not expose its routing table, so the DHT nodes that
+// query ours are remembered as its contacts instead. They are saved in the
+// state file, and the DHT is joined through them on the next start.
+type dhtContacts struct {
+	mu    sync.Mutex
+	addrs []string // the most recent last
+}
+
+// GetPeers is called by the DHT library for every get_peers query.
+func (c *dhtContacts) GetPeers(addr net.UDPAddr, queryID string, ih dht.InfoHash) {
+	c.add(addr.String())
+}
+
+// remembers a contact, forgetting the oldest one if there are too many
+func (c *dhtContacts) add(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs = slices.DeleteFunc(c.addrs, func(a string) bool { return a == address })
+	c.addrs = append(c.addrs, address)
+	if len(c.addrs) > MAX_CACHED_NODES {
+		c.addrs = c.addrs[1:]
+	}
+}
+
+// returns the contacts, the most recent first
+func (c *dhtContacts) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := slices.Clone(c.addrs)
+	slices.Reverse(addrs)
+	return addrs
+}
+
+// creates a backend running a DHT node on port
+func NewDHTBackend(port int) *DHTBackend {
+	return &DHTBackend{
+		port:           port,
+		IPv6:           true,
+		BootstrapNodes: DEFAULT_BOOTSTRAP_NODES,
+		logger:         slog.Default(),
+	}
+}
+
+// Port returns the UDP port of the DHT nodes. If the backend was created
+// with port 0, it is only known after Start.
+func (b *DHTBackend) Port() int {
+	return b.port
+}
+
+func (b *DHTBackend) setLogger(logger *slog.Logger) {
+	b.logger = logger
+}
+
+func (b *DHTBackend) Name() string {
+	return "dht"
+}
+
+// Start joins the DHT. It only fails if no node could be started, so IPv4-only
+// and IPv6-only hosts are fine.
+func (b *DHTBackend) Start(ctx context.Context, services []*Service, candidates chan<- Candidate) error {
+	protos := []string{"udp4"}
+	if b.IPv6 {
+		protos = append(protos, "udp6")
+	}
+
+	var lastErr error
+	for _, proto := range protos {
+		if node, err := b.startNode(proto); err != nil {
+			b.logger.Warn("could not join the DHT", "stage", "dht", "proto", proto, "err", err)
+			lastErr = err
+		} else {
+			b.dhts = append(b.dhts, node)
+			// the other node binds the same port as the first one
+			if b.port == 0 {
+				b.port = node.Port()
+			}
+		}
+	}
+	if len(b.dhts) == 0 {
+		return lastErr
+	}
+
+	b.chain = newBootstrapChain(b.BootstrapNodes, b.logger)
+	for _, node := range b.nodes {
+		b.chain.remember(node)
+	}
+	b.services = services
+	b.lastResult = time.Now()
+
+	for _, node := range b.dhts {
+		// join through the nodes of the previous run right away, along
+		// with the bootstrap chain
+		for _, address := range b.nodes {
+			if host, _, err := net.SplitHostPort(address); err == nil && ipProto(host) == node.proto {
+				node.AddNode(address)
+			}
+		}
+		b.wg.Add(2)
+		go b.bootstrap(ctx, node)
+		go b.readResults(ctx, node, candidates)
+	}
+	return nil
+}
+
+// creates and starts a DHT node
+func (b *DHTBackend) startNode(proto string) (*dhtNode, error) {
+	// Connect to the DHT network
+	b.logger.Info("connecting to the DHT network", "stage", "dht", "proto", proto)
+	config := dht.NewConfig()
+	config.Address = b.Address
+	config.Port = b.port
+	config.UDPProto = proto
+	// only the bootstrap chain is used for joining the DHT, and the good
+	// nodes are kept in our state file (see Nodes)
+	config.DHTRouters = ""
+	config.SaveRoutingTable = false
+	dhtService, err := dht.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the DHT node: %v", err)
+	}
+
+	dhtService.Logger = &b.contacts
+	if err := dhtService.Start(); err != nil {
+		return nil, fmt.Errorf("could not start the DHT node: %v", err)
+	}
+	return &dhtNode{proto: proto, DHT: dhtService}, nil
+}
+
+// sends the peers found by a DHT node as candidates, until ctx is cancelled
+func (b *DHTBackend) readResults(ctx context.Context, node *dhtNode, candidates chan<- Candidate) {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-node.PeersRequestResults:
+			b.mu.Lock()
+			b.lastResult = time.Now()
+			b.mu.Unlock()
+			for ih, peers := range r {
+				service := b.serviceFor(ih, time.Now())
+				if service == nil {
+					continue
+				}
+				for _, x := range peers {
+					// A DHT peer for our infohash was found. It
+					// needs to be authenticated.
+					address := dht.DecodePeerAddress(x)
+					b.logger.Debug("discovered possible peer", "stage", "dht", "service", service.Name, "peer", address)
+					sendCandidate(ctx, candidates, Candidate{Service: service, Addr: address, Source: b.Name()})
+				}
+			}
+		}
+	}
+}
+
+// returns the service using infohash ih at time now, or nil
+func (b *DHTBackend) serviceFor(ih dht.InfoHash, now time.Time) *Service {
+	for _, s := range b.services {
+		if s.hasInfoHash(ih, now) {
+			return s
+		}
+	}
+	return nil
+}
+
+// joins the DHT through the bootstrap chain, and joins it again if it stops
+// giving results, until ctx is cancelled.
+func (b *DHTBackend) bootstrap(ctx context.Context, node *dhtNode) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(DEFAULT_BOOTSTRAP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		// previously verified peers run DHT nodes too
+		var fallbacks []string
+		for _, s := range b.services {
+			for _, p := range s.Peers() {
+				if address := peerDHTAddr(p); address != "" {
+					fallbacks = append(fallbacks, address)
+				}
+			}
+		}
+		if b.chain.bootstrap(ctx, node.proto, node.AddNode, fallbacks, BOOTSTRAP_NODES_WANTED) == 0 {
+			b.logger.Warn("no bootstrap node is reachable", "stage", "bootstrap", "proto", node.proto)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			b.mu.Lock()
+			stale := time.Since(b.lastResult) > DEFAULT_BOOTSTRAP_INTERVAL
+			b.mu.Unlock()
+			if stale {
+				break
+			}
+		}
+	}
+}
+
+// returns the address of the DHT node of a verified peer: the port it
+// advertises with DHT_ENDPOINT, or else the one after its authentication port
+func peerDHTAddr(p Peer) string {
+	host, port, err := net.SplitHostPort(p.AuthAddr)
+	if err != nil {
+		return ""
+	}
+	for _, e := range p.Endpoints {
+		if e.Name == DHT_ENDPOINT && e.Protocol == "udp" {
+			return net.JoinHostPort(host, strconv.Itoa(int(e.Port)))
+		}
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n >= 65535 {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+1))
+}
+
+// SetNodes sets DHT nodes known to be good, e.g. from a previous run. The
+// DHT is joined through them as soon as it starts, along with the bootstrap
+// nodes. It must be called before Start.
+func (b *DHTBackend) SetNodes(nodes []string) {
+	b.nodes = nodes
+}
+
+// Nodes returns the DHT nodes known to be good: the contacts of our DHT
+// nodes, the most recent first, and then the ones set with SetNodes.
+func (b *DHTBackend) Nodes() []string {
+	nodes := b.contacts.list()
+	for _, node := range b.nodes {
+		if len(nodes) >= MAX_CACHED_NODES {
+			break
+		}
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (b *DHTBackend) Lookup(s *Service) {
+	// This is a no-op if the DHT is satisfied with the number of
+	// peers it has found.
+	for _, ih := range s.infoHashes(time.Now()) {
+		for _, node := range b.dhts {
+			if b.AnnouncePort > 0 {
+				node.PeersRequestPort(string(ih), s.announced(), b.AnnouncePort)
+			} else {
+				node.PeersRequest(string(ih), s.announced())
+			}
+		}
+	}
+}
+
+func (b *DHTBackend) Stop() error {
+	for _, node := range b.dhts {
+		node.Stop()
+	}
+	b.wg.Wait()
+	return nil
+}
@@ -0,0 +1,212 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// IPv6 link-local multicast group used for finding peers in the LAN
+const LAN_MULTICAST_GROUP = "ff02::6469:7363"
+
+// IPv4 broadcast address used for finding peers in the LAN
+const LAN_BROADCAST = "255.255.255.255"
+
+// A LANBackend finds candidates in the local network, in milliseconds and
+// without depending on the DHT. For every lookup it sends a challenge for the
+// service to the IPv4 broadcast address and to an IPv6 link-local multicast
+// group, on the authentication port of the peers. Every peer that answers
+// with a nonce for the challenge, or with a valid response if it is an older
+// one, becomes a candidate. For the services verified with Noise, the start of
+// a Noise handshake is sent instead of the challenge, and the peers answer it
+// with a cookie.
+//
+// The peers must use the same authentication port as the one the backend was
+// created with.
+type LANBackend struct {
+	port int
+
+	// IPv4 addresses the challenges are sent to. LAN_BROADCAST by default.
+	Targets []string
+	// IPv6 multicast group the challenges are sent to, and that our
+	// AuthServer joins. LAN_MULTICAST_GROUP by default, empty to disable.
+	MulticastGroup string
+
+	ctx        context.Context
+	candidates chan<- Candidate
+
+	conn4 *net.UDPConn
+	conn6 *net.UDPConn
+
+	mu      sync.Mutex
+	pending map[*Service]*Challenge // last challenge sent for each service
+
+	wg     sync.WaitGroup
+	logger *slog.Logger
+}
+
+// creates a backend looking for peers that answer challenges on port in the
+// local network.
+func NewLANBackend(port int) *LANBackend {
+	return &LANBackend{
+		port:           port,
+		Targets:        []string{LAN_BROADCAST},
+		MulticastGroup: LAN_MULTICAST_GROUP,
+		pending:        make(map[*Service]*Challenge),
+		logger:         slog.Default(),
+	}
+}
+
+func (b *LANBackend) setLogger(logger *slog.Logger) {
+	b.logger = logger
+}
+
+func (b *LANBackend) Name() string {
+	return "lan"
+}
+
+func (b *LANBackend) Start(ctx context.Context, services []*Service, candidates chan<- Candidate) error {
+	b.ctx = ctx
+	b.candidates = candidates
+
+	conn4, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return fmt.Errorf("could not open a UDP socket: %v", err)
+	}
+	b.conn4 = conn4
+	b.wg.Add(1)
+	go b.readResponses(conn4)
+
+	if b.MulticastGroup != "" {
+		if conn6, err := net.ListenUDP("udp6", &net.UDPAddr{}); err != nil {
+			// IPv4-only host
+			b.logger.Info("could not open a UDP IPv6 socket", "stage", "lan", "err", err)
+		} else {
+			b.conn6 = conn6
+			b.wg.Add(1)
+			go b.readResponses(conn6)
+		}
+	}
+	return nil
+}
+
+// sends a challenge for the service to all the LAN targets
+func (b *LANBackend) Lookup(s *Service) {
+	challenge, err := NewChallenge()
+	if err != nil {
+		b.logger.Error("could not create a challenge", "stage", "lan", "err", err)
+		return
+	}
+	challenge.KeyHint = s.keys().hint
+	challenge.KDF = s.kdf
+	challenge.Flags = FLAG_MUTUAL
+	challengeBuf, err := challenge.ToBuffer()
+	if err != nil {
+		return
+	}
+	msg := challengeBuf.Bytes()
+	if s.noise {
+		if _, msg, err = newNoiseInit(s.keys(), 0); err != nil {
+			b.logger.Error("could not start a Noise handshake", "stage", "lan", "err", err)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	b.pending[s] = challenge
+	b.mu.Unlock()
+
+	port := strconv.Itoa(b.port)
+	for _, target := range b.Targets {
+		if addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(target, port)); err != nil {
+			b.logger.Warn("invalid LAN target", "stage", "lan", "target", target, "err", err)
+		} else if _, err := b.conn4.WriteToUDP(msg, addr); err != nil {
+			b.logger.Debug("could not send a challenge", "stage", "lan", "peer", addr, "err", err)
+		}
+	}
+
+	if b.conn6 != nil {
+		for _, iface := range multicastInterfaces() {
+			addr := &net.UDPAddr{IP: net.ParseIP(b.MulticastGroup), Port: b.port, Zone: iface.Name}
+			if _, err := b.conn6.WriteToUDP(msg, addr); err != nil {
+				b.logger.Debug("could not send a challenge", "stage", "lan", "peer", addr, "err", err)
+			}
+		}
+	}
+}
+
+// reads the responses to our challenges, until the socket is closed
+func (b *LANBackend) readResponses(conn *net.UDPConn) {
+	defer b.wg.Done()
+
+	buf := make([]byte, LEN_UDP_BUF)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		// find the service the response is for
+		b.mu.Lock()
+		nonce, _ := parseNonce(buf[:n])
+		hint, kdf, _, noiseErr := parseNoiseFrame(buf[:n], MSG_NOISE_COOKIE)
+		for s, challenge := range b.pending {
+			// the cookies answering Noise handshakes have the key hint
+			if noiseErr == nil && s.noise && hint == s.keys().hint && kdf == s.kdf {
+				b.logger.Debug("discovered possible peer", "stage", "lan", "service", s.Name, "peer", addr)
+				go sendCandidate(b.ctx, b.candidates, Candidate{Service: s, Addr: addr.String(), Source: b.Name()})
+				break
+			}
+			// peers only answer with a nonce if they know the key hint
+			if nonce != nil && nonce.Challenge == challenge.Challenge {
+				b.logger.Debug("discovered possible peer", "stage", "lan", "service", s.Name, "peer", addr)
+				go sendCandidate(b.ctx, b.candidates, Candidate{Service: s, Addr: addr.String(), Source: b.Name()})
+				break
+			}
+			if _, ok := challenge.VerifyResponse(bytes.NewBuffer(buf[:n]), nil, s.keys().mac); ok {
+				b.logger.Debug("discovered possible peer", "stage", "lan", "service", s.Name, "peer", addr)
+				go sendCandidate(b.ctx, b.candidates, Candidate{Service: s, Addr: addr.String(), Source: b.Name()})
+				break
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// returns the multicast groups our AuthServer must join
+func (b *LANBackend) multicastGroups() []string {
+	if b.MulticastGroup == "" {
+		return nil
+	}
+	return []string{b.MulticastGroup}
+}
+
+func (b *LANBackend) Stop() error {
+	if b.conn4 != nil {
+		b.conn4.Close()
+	}
+	if b.conn6 != nil {
+		b.conn6.Close()
+	}
+	b.wg.Wait()
+	return nil
+}
+
+// returns the interfaces that are up and support multicast
+func multicastInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var result []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			result = append(result, iface)
+		}
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package discover
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLANBackend(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	for _, noise := range []bool{false, true} {
+		config := DefaultConfig()
+		config.Noise = noise
+		server := newAuthServer("127.0.0.1:0", 3000, passphrase, &config)
+		startServer(t, server)
+
+		// on loopback, a unicast target stands for the broadcast address
+		b := NewLANBackend(server.Addr().(*net.UDPAddr).Port)
+		b.Targets = []string{"127.0.0.1"}
+		b.MulticastGroup = ""
+
+		ctx, cancel := context.WithCancel(context.Background())
+		candidates := make(chan Candidate, 1)
+		s, _ := newService(DEFAULT_SERVICE, -1, passphrase, &config)
+		if err := b.Start(ctx, []*Service{s}, candidates); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+
+		// peers of other services don't answer
+		other, _ := newService("other", -1, []byte("other"), &config)
+		b.Lookup(other)
+		b.Lookup(s)
+
+		select {
+		case c := <-candidates:
+			if c.Service != s || c.Addr != server.Addr().String() {
+				t.Errorf("Noise %v: unexpected candidate %+v", noise, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Noise %v: no candidate found", noise)
+		}
+
+		cancel()
+		b.Stop()
+		server.Close()
+	}
+}
+
+func TestLANMulticast(t *testing.T) {
+	if len(multicastInterfaces()) == 0 {
+		t.Skip("no multicast interface")
+	}
+
+	// listening on all the addresses, as by default
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer(":0", 3000, passphrase)
+	startServer(t, server)
+	if err := server.JoinMulticast(LAN_MULTICAST_GROUP); err != nil {
+		t.Fatalf("JoinMulticast: %v", err)
+	}
+
+	b := NewLANBackend(server.Addr().(*net.UDPAddr).Port)
+	b.Targets = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	candidates := make(chan Candidate, 1)
+	config := DefaultConfig()
+	s, _ := newService(DEFAULT_SERVICE, -1, passphrase, &config)
+	if err := b.Start(ctx, []*Service{s}, candidates); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer b.Stop()
+	b.Lookup(s)
+
+	select {
+	case c := <-candidates:
+		if c.Service != s {
+			t.Errorf("Unexpected candidate %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No candidate found through the multicast group")
+	}
+}
@@ -0,0 +1,192 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// DHT bootstrap
+///////////////////////////////////////////////////////////////////////
+
+// DHT nodes used for joining the network, tried in this order.
+var DEFAULT_BOOTSTRAP_NODES = []string{
+	DEFAULT_DHT_NODE,
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// A configured bootstrap node and its health.
+type bootstrapNode struct {
+	addr     string // host:port, where host can be a DNS name
+	failures int    // failed attempts in a row
+	lastOK   time.Time
+}
+
+// The chain of nodes used for joining the DHT. The configured nodes are tried
+// first, healthiest first and otherwise in the configured order. If none of
+// them answers, the fallback nodes (previously verified peers, nodes that
+// answered before) are tried.
+type bootstrapChain struct {
+	mu     sync.Mutex
+	nodes  []*bootstrapNode
+	cached []string // nodes that answered before
+
+	ping    func(ctx context.Context, address string) error
+	resolve func(ctx context.Context, host string) ([]string, error)
+	logger  *slog.Logger
+}
+
+func newBootstrapChain(addresses []string, logger *slog.Logger) *bootstrapChain {
+	c := &bootstrapChain{
+		ping:    pingNode,
+		resolve: net.DefaultResolver.LookupHost,
+		logger:  logger,
+	}
+	for _, address := range addresses {
+		c.nodes = append(c.nodes, &bootstrapNode{addr: address})
+	}
+	return c
+}
+
+// bootstrap adds to the DHT (with add) up to wanted nodes of the proto IP
+// version ("udp4" or "udp6") that answer our pings, and returns how many were
+// added.
+func (c *bootstrapChain) bootstrap(ctx context.Context, proto string, add func(address string), fallbacks []string, wanted int) int {
+	c.mu.Lock()
+	nodes := append([]*bootstrapNode(nil), c.nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].failures < nodes[j].failures })
+	c.mu.Unlock()
+
+	added := make(map[string]bool)
+	for _, node := range nodes {
+		if len(added) >= wanted || ctx.Err() != nil {
+			return len(added)
+		}
+		if address, err := c.tryNode(ctx, proto, node.addr); err != nil {
+			c.logger.Info("bootstrap node failed", "stage", "bootstrap", "node", node.addr, "err", err)
+			c.mu.Lock()
+			node.failures++
+			c.mu.Unlock()
+		} else {
+			c.logger.Info("adding DHT node", "stage", "bootstrap", "node", address)
+			add(address)
+			added[address] = true
+			c.mu.Lock()
+			node.failures = 0
+			node.lastOK = time.Now()
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	fallbacks = append(fallbacks, c.cached...)
+	c.mu.Unlock()
+	for _, fallback := range fallbacks {
+		if len(added) >= wanted || ctx.Err() != nil {
+			break
+		}
+		if added[fallback] {
+			continue
+		}
+		if address, err := c.tryNode(ctx, proto, fallback); err == nil && !added[address] {
+			c.logger.Info("adding fallback DHT node", "stage", "bootstrap", "node", address)
+			add(address)
+			added[address] = true
+		}
+	}
+	return len(added)
+}
+
+// resolves a node and pings its addresses of the proto IP version, returning
+// the first one that answers. Nodes that answer are remembered as fallbacks.
+func (c *bootstrapChain) tryNode(ctx context.Context, proto string, node string) (string, error) {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return "", err
+	}
+	ips, err := c.resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ipProto(ip) != proto {
+			continue
+		}
+		address := net.JoinHostPort(ip, port)
+		if err = c.ping(ctx, address); err == nil {
+			c.remember(address)
+			return address, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	return "", err
+}
+
+// remembers a node that answered
+func (c *bootstrapChain) remember(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cached := range c.cached {
+		if cached == address {
+			return
+		}
+	}
+	c.cached = append(c.cached, address)
+	if len(c.cached) > MAX_CACHED_NODES {
+		c.cached = c.cached[1:]
+	}
+}
+
+// returns "udp4" or "udp6" for an IP address
+func ipProto(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// pingNode sends a KRPC ping to a DHT node and returns nil if it answers.
+func pingNode(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return ERR_COULD_NOT_CONNECT
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DEFAULT_PING_TIMEOUT))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	id, err := randMsg()
+	if err != nil {
+		return err
+	}
+	tid, err := randMsg()
+	if err != nil {
+		return err
+	}
+	ping := fmt.Sprintf("d1:ad2:id20:%se1:q4:ping1:t2:%s1:y1:qe", id, tid[:2])
+	if _, err := conn.Write([]byte(ping)); err != nil {
+		return ERR_COULD_NOT_SEND
+	}
+
+	buf := make([]byte, LEN_UDP_BUF)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ERR_DID_NOT_RESPOND
+	}
+	if !bytes.Contains(buf[:n], []byte("1:y1:r")) || !bytes.Contains(buf[:n], append([]byte("1:t2:"), tid[:2]...)) {
+		return ERR_IS_NOT_PEER
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package discover
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBootstrapChain(t *testing.T) {
+	c := newBootstrapChain([]string{"a:1", "b:1", "c:1"}, slog.Default())
+	c.resolve = func(ctx context.Context, host string) ([]string, error) { return []string{host}, nil }
+	alive := map[string]bool{"b:1": true, "c:1": true, "peer:1": true}
+	c.ping = func(ctx context.Context, address string) error {
+		if !alive[address] {
+			return ERR_DID_NOT_RESPOND
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	var added []string
+	add := func(address string) { added = append(added, address) }
+
+	// tried in order, skipping the nodes that don't answer
+	if n := c.bootstrap(ctx, "udp4", add, nil, 1); n != 1 || !reflect.DeepEqual(added, []string{"b:1"}) {
+		t.Errorf("Wanted [b:1], got %v", added)
+	}
+
+	// the healthy nodes go first
+	added = nil
+	c.bootstrap(ctx, "udp4", add, nil, 3)
+	if !reflect.DeepEqual(added, []string{"b:1", "c:1"}) {
+		t.Errorf("Wanted [b:1 c:1], got %v", added)
+	}
+
+	// fall back to known peers when the configured nodes are unreachable
+	alive = map[string]bool{"peer:1": true}
+	added = nil
+	c.bootstrap(ctx, "udp4", add, []string{"peer:1"}, 1)
+	if !reflect.DeepEqual(added, []string{"peer:1"}) {
+		t.Errorf("Wanted [peer:1], got %v", added)
+	}
+}
+
+func TestPeerDHTAddr(t *testing.T) {
+	if endpoints := advertisedEndpoints(nil, 4000, 4001); len(endpoints) != 0 {
+		t.Errorf("Default DHT port advertised: %v", endpoints)
+	}
+	if endpoints := advertisedEndpoints(nil, 4000, 0); len(endpoints) != 0 {
+		t.Errorf("Unknown DHT port advertised: %v", endpoints)
+	}
+	endpoints := advertisedEndpoints(nil, 4000, 6881)
+
+	for _, tc := range []struct {
+		peer Peer
+		want string
+	}{
+		{Peer{AuthAddr: "10.0.0.1:4000"}, "10.0.0.1:4001"},
+		{Peer{AuthAddr: "10.0.0.1:4000", Endpoints: endpoints}, "10.0.0.1:6881"},
+		{Peer{AuthAddr: "[2001:db8::1]:4000", Endpoints: endpoints}, "[2001:db8::1]:6881"},
+		{Peer{AuthAddr: "10.0.0.1:65535"}, ""},
+	} {
+		if got := peerDHTAddr(tc.peer); got != tc.want {
+			t.Errorf("Wanted %q for %+v, got %q", tc.want, tc.peer, got)
+		}
+	}
+}
+
+func TestDHTContacts(t *testing.T) {
+	b := NewDHTBackend(0)
+	b.IPv6 = false
+	b.BootstrapNodes = []string{"127.0.0.1:1"}
+	b.SetNodes([]string{"192.0.2.1:6881"})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.Start(ctx, nil, make(chan Candidate)); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer b.Stop()
+	defer cancel()
+
+	// the nodes querying ours are its contacts, saved instead of the
+	// bootstrap nodes
+	for _, address := range []string{"192.0.2.2:6881", "192.0.2.3:6881", "192.0.2.2:6881"} {
+		addr, _ := net.ResolveUDPAddr("udp", address)
+		b.dhts[0].Logger.GetPeers(*addr, "id", "")
+	}
+	want := []string{"192.0.2.2:6881", "192.0.2.3:6881", "192.0.2.1:6881"}
+	if nodes := b.Nodes(); !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Wanted %v, got %v", want, nodes)
+	}
+}
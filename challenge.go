@@ -2,9 +2,11 @@ package discover
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"io"
 )
 
 // Connect on that peer's TCP port and authenticate. Alice starts a
@@ -19,20 +21,57 @@ import (
 // Result: Alice now knows that bob:portX is a valid member of the connection pool.
 //
 // In the real world, the above is done in only one message each way. Protocol:
-// - sends initial messsage of 36 bytes, containing:
+// - sends initial messsage of 42 bytes, containing:
 //   ~ magicHeader with "wherez" ASCII encoded.
 //   ~ 10 byte dedupe ID, which the remote node uses to identify
 //   connection to self.
 //   ~ 20 bytes challenge.
+//   ~ 4 bytes key hint, which the remote node uses to select the passphrase
+//   when it serves several services.
+//   ~ 1 byte with the key derivation scheme (see keys.go).
+//   ~ 1 byte of flags. With FLAG_METADATA, the client wants the metadata,
+//   with FLAG_ENDPOINTS the endpoints, with FLAG_HOSTS the hosts, and with
+//   FLAG_IDENTITY the signed identity of the node (see identity.go).
+//   Older nodes send 36 bytes without the hint, 40 without the scheme, or 41
+//   without the flags. Without a scheme, KDF_LEGACY is used.
 // - the other endpoint sends a 20 bytes message containing 2 bytes
 // relative to the application port, plus 32 bytes of message MAC, calculated from
-// the 20 bytes of client challenge.
-// The MAC should be generated using the shared passphrase.
+// the 20 bytes of client challenge, plus the metadata, endpoints, hosts and
+// identity sections if the client asked for them, in that order (see
+// metadata.go, endpoints.go and identity.go).
+// The MAC should be generated using the MAC key derived from the shared
+// passphrase with the scheme of the challenge, over the challenge and the
+// sections.
+//
+// With FLAG_MUTUAL, Bob first makes sure that Alice knows the passphrase too,
+// so that only members of the group learn his port:
+// - Bob answers the challenge with a Nonce message of 56 bytes: the
+// magicHeader, his 10 bytes dedupe ID, the 20 bytes of the challenge and 20
+// bytes of nonce. He only does if he knows the key hint, and he keeps no
+// state: the nonce is a MAC of the challenge and of Alice's address, with a
+// key only he knows, which changes every NONCE_LIFETIME.
+// - Alice sends a Proof message of 94 bytes: her challenge again, the nonce,
+// and a MAC of the transcript of the handshake with the MAC key.
+// - Bob checks the nonce and the MAC, and sends the response above. Its MAC
+// is computed over the transcript, the port and the sections, so none of
+// them can be changed, and it cannot be passed off as the response to
+// another handshake.
+// The transcript is PROTOCOL_VERSION, then the dedupe ID, challenge, key
+// hint, scheme and flags of the challenge, then the dedupe ID of Bob and the
+// nonce. The MACs start with a label telling proofs and responses apart.
+// Older nodes answer challenges with FLAG_MUTUAL at once, and only answer
+// one-shot challenges; talking to them needs Config.LegacyAuth.
+//
+// The messages above are the ones of the v1 framing. Newer nodes send the
+// same messages as v2 frames, see wire.go.
 
 type Challenge struct {
 	MagicHeader [6]byte
 	Dedupe      [10]byte
 	Challenge   [20]byte
+	KeyHint     [LEN_KEY_HINT]byte
+	KDF         byte // key derivation scheme
+	Flags       byte
 }
 
 // Response containing proof that the server (Bob) knows the shared secret and
@@ -40,6 +79,53 @@ type Challenge struct {
 type Response struct {
 	Port uint16
 	MAC  [32]byte // MAC of the Challenge sent by the client (Alice).
+
+	// Metadata, endpoints and hosts of the server, if the client asked for
+	// them with FLAG_METADATA, FLAG_ENDPOINTS and FLAG_HOSTS and the server
+	// supports them.
+	Metadata  map[string]string
+	Endpoints []Endpoint
+	Hosts     []string
+
+	// Public key of the server, if the client asked for it with FLAG_IDENTITY
+	// and the server has one. The server has signed the response with it.
+	PublicKey ed25519.PublicKey
+
+	// Secret shared with the server, unless the challenge was one-shot.
+	Session *Session
+
+	sections []byte // the sections, as sent
+}
+
+// Sent by the server in answer to a challenge with FLAG_MUTUAL, asking the
+// client to prove that it knows the passphrase.
+type Nonce struct {
+	MagicHeader [6]byte
+	Dedupe      [10]byte // of the server
+	Challenge   [20]byte // the challenge it answers
+	Nonce       [LEN_NONCE]byte
+}
+
+// Sent by the client in answer to a Nonce.
+type Proof struct {
+	Challenge Challenge
+	Nonce     [LEN_NONCE]byte
+	MAC       [32]byte // MAC of the transcript
+}
+
+// the optional sections of a response, in order, by the flag requesting them
+var responseSections = []byte{FLAG_METADATA, FLAG_ENDPOINTS, FLAG_HOSTS, FLAG_IDENTITY}
+
+// a section with nothing, sent when the server has nothing to say
+var emptySection = []byte{0, 0}
+
+// keyHint identifies the passphrase used for a KDF_LEGACY challenge, without
+// giving out anything useful about it.
+func keyHint(passphrase []byte) (hint [LEN_KEY_HINT]byte) {
+	mac := hmac.New(sha256.New, passphrase)
+	mac.Write([]byte("discover key hint"))
+	copy(hint[:], mac.Sum(nil))
+	return hint
 }
 
 func NewChallenge() (*Challenge, error) {
@@ -54,6 +140,29 @@ func NewChallenge() (*Challenge, error) {
 	return &m, nil
 }
 
+// Parse a challenge received from a remote peer. Challenges from older peers
+// have no key hint or scheme, and they are left empty.
+func parseChallenge(buf []byte) (*Challenge, error) {
+	challenge := new(Challenge)
+	if len(buf) < LEN_CHALLENGE_V1 {
+		return nil, ERR_IS_NOT_PEER
+	}
+	if len(buf) < binary.Size(challenge) {
+		padded := make([]byte, binary.Size(challenge))
+		for _, n := range []int{LEN_CHALLENGE_V3, LEN_CHALLENGE_V2, LEN_CHALLENGE_V1} {
+			if len(buf) >= n {
+				copy(padded, buf[:n])
+				break
+			}
+		}
+		buf = padded
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, challenge); err != nil {
+		return nil, ERR_IS_NOT_PEER
+	}
+	return challenge, nil
+}
+
 // Obtain the challenge as a buffer, for sending to the remote peer
 func (challenge *Challenge) ToBuffer() (*bytes.Buffer, error) {
 	challengeBuf := new(bytes.Buffer)
@@ -65,22 +174,196 @@ func (challenge *Challenge) ToBuffer() (*bytes.Buffer, error) {
 	return challengeBuf, nil
 }
 
-// Verify a reponse that has been returned for this challenge
+// NewProof returns the proof that we know the MAC key, for a nonce sent by
+// the server in answer to this challenge.
+func (challenge *Challenge) NewProof(nonce *Nonce, macKey []byte) *Proof {
+	proof := &Proof{Challenge: *challenge, Nonce: nonce.Nonce}
+	copy(proof.MAC[:], transcriptMAC(macKey, "discover proof", transcript(challenge, nonce)))
+	return proof
+}
+
+// returns the transcript of a mutual handshake, see above
+func transcript(challenge *Challenge, nonce *Nonce) []byte {
+	t := new(bytes.Buffer)
+	t.WriteByte(PROTOCOL_VERSION)
+	t.Write(challenge.Dedupe[:])
+	t.Write(challenge.Challenge[:])
+	t.Write(challenge.KeyHint[:])
+	t.WriteByte(challenge.KDF)
+	t.WriteByte(challenge.Flags)
+	t.Write(nonce.Dedupe[:])
+	t.Write(nonce.Nonce[:])
+	return t.Bytes()
+}
+
+// returns the MAC of a transcript and what follows it, with a label so that
+// proofs cannot be passed off as responses
+func transcriptMAC(macKey []byte, label string, transcript []byte, rest ...[]byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(label))
+	mac.Write(transcript)
+	for _, b := range rest {
+		mac.Write(b)
+	}
+	return mac.Sum(nil)
+}
+
+// Obtain the proof as a buffer, for sending to the server
+func (proof *Proof) ToBuffer() (*bytes.Buffer, error) {
+	proofBuf := new(bytes.Buffer)
+	if err := binary.Write(proofBuf, binary.LittleEndian, proof); err != nil {
+		return nil, err
+	}
+	return proofBuf, nil
+}
+
+// Parse a proof received from a client.
+func parseProof(buf []byte) (*Proof, error) {
+	proof := new(Proof)
+	if len(buf) != LEN_PROOF {
+		return nil, ERR_IS_NOT_PEER
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, proof); err != nil {
+		return nil, ERR_IS_NOT_PEER
+	}
+	return proof, nil
+}
+
+// Obtain the nonce as a buffer, for sending to the client
+func (nonce *Nonce) ToBuffer() (*bytes.Buffer, error) {
+	nonceBuf := new(bytes.Buffer)
+	if err := binary.Write(nonceBuf, binary.LittleEndian, nonce); err != nil {
+		return nil, err
+	}
+	return nonceBuf, nil
+}
+
+// Parse a nonce received from a server. Anything else, e.g. the response of
+// an older server, is ERR_IS_NOT_PEER.
+func parseNonce(buf []byte) (*Nonce, error) {
+	nonce := new(Nonce)
+	if len(buf) != LEN_NONCE_MSG {
+		return nil, ERR_IS_NOT_PEER
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, nonce); err != nil {
+		return nil, ERR_IS_NOT_PEER
+	}
+	if !bytes.Equal(nonce.MagicHeader[:], magicHeader[:len(nonce.MagicHeader)]) {
+		return nil, ERR_IS_NOT_PEER
+	}
+	return nonce, nil
+}
+
+// Verify a reponse that has been returned for this challenge, with the MAC
+// key derived from the passphrase. With KDF_LEGACY, the key is the
+// passphrase. After a mutual handshake, nonce is the one the server sent, and
+// the MAC must cover the transcript; a nil nonce is for the responses to
+// one-shot challenges, whose MAC does not cover the port.
 func (challenge *Challenge) VerifyResponse(responseBuffer *bytes.Buffer,
-	passphrase []byte) (*Response, bool) {
+	nonce *Nonce, macKey []byte) (*Response, bool) {
 
 	var response = new(Response)
-	if err := binary.Read(responseBuffer, binary.LittleEndian, response); err != nil {
+	if err := binary.Read(responseBuffer, binary.LittleEndian, &response.Port); err != nil {
+		return nil, false
+	}
+	if _, err := io.ReadFull(responseBuffer, response.MAC[:]); err != nil {
 		return nil, false
 	}
+	return challenge.verifyResponse(response, responseBuffer.Bytes(), nonce, macKey)
+}
 
-	var message, messageMAC []byte = challenge.Challenge[:], response.MAC[:]
-	mac := hmac.New(sha256.New, passphrase)
-	mac.Write(message)
-	expectedMAC := mac.Sum(nil)
+// decodes the sections of a response, and verifies its MAC
+func (challenge *Challenge) verifyResponse(response *Response, sections []byte,
+	nonce *Nonce, macKey []byte) (*Response, bool) {
 
-	if !hmac.Equal(messageMAC, expectedMAC) {
+	if !response.decodeSections(challenge.Flags, sections, responseBinding(challenge, nonce)) {
+		return nil, false
+	}
+	if !hmac.Equal(response.MAC[:], response.mac(challenge, nonce, macKey, sections)) {
 		return nil, false
 	}
 	return response, true
 }
+
+// decodes the sections of a response that were asked for with flags. The
+// identity is signed along with binding.
+func (response *Response) decodeSections(flags byte, sections, binding []byte) bool {
+	// older servers don't send the sections
+	rest := sections
+	for _, flag := range responseSections {
+		if flags&flag == 0 || len(rest) == 0 {
+			continue
+		}
+		section, r, err := splitSection(rest)
+		if err != nil {
+			return false
+		}
+		switch flag {
+		case FLAG_METADATA:
+			response.Metadata, err = decodeMetadata(section)
+		case FLAG_ENDPOINTS:
+			response.Endpoints, err = decodeEndpoints(section)
+		case FLAG_HOSTS:
+			response.Hosts, err = decodeHosts(section)
+		case FLAG_IDENTITY:
+			signed := identitySigned(binding, response.Port, sections[:len(sections)-len(rest)])
+			response.PublicKey, err = decodeIdentity(section, signed)
+		}
+		if err != nil {
+			return false
+		}
+		rest = r
+	}
+	return len(rest) == 0
+}
+
+// returns the sections asked for with flags, for a key. The identity section
+// is signed with identity, along with binding.
+func appendSections(key serverKey, identity ed25519.PrivateKey, flags byte, port uint16, binding []byte) []byte {
+	var sections []byte
+	for _, flag := range responseSections {
+		if flags&flag != 0 {
+			section, found := key.sections[flag]
+			if flag == FLAG_IDENTITY {
+				section, found = encodeIdentity(identity, identitySigned(binding, port, sections)), true
+			}
+			if !found {
+				section = emptySection
+			}
+			sections = append(sections, section...)
+		}
+	}
+	return sections
+}
+
+// returns what the identity of a response is bound to: the challenge, or the
+// transcript after a mutual handshake
+func responseBinding(challenge *Challenge, nonce *Nonce) []byte {
+	if nonce == nil {
+		return challenge.Challenge[:]
+	}
+	return transcript(challenge, nonce)
+}
+
+// returns the MAC of a response with sections, see VerifyResponse
+func (response *Response) mac(challenge *Challenge, nonce *Nonce, macKey, sections []byte) []byte {
+	if nonce == nil {
+		mac := hmac.New(sha256.New, macKey)
+		mac.Write(challenge.Challenge[:])
+		mac.Write(sections)
+		return mac.Sum(nil)
+	}
+	port := binary.LittleEndian.AppendUint16(nil, response.Port)
+	return transcriptMAC(macKey, "discover response", transcript(challenge, nonce), port, sections)
+}
+
+// Obtain the response as a buffer, for sending to the client
+func (response *Response) ToBuffer() (*bytes.Buffer, error) {
+	responseBuf := new(bytes.Buffer)
+	if err := binary.Write(responseBuf, binary.LittleEndian, response.Port); err != nil {
+		return nil, err
+	}
+	responseBuf.Write(response.MAC[:])
+	responseBuf.Write(response.sections)
+	return responseBuf, nil
+}
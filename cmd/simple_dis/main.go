@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"strconv"
 
@@ -19,6 +23,14 @@ const STUN_SERVICE_PORT = 3478
 
 func main() {
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	var lan = flag.Bool("lan", false, "also look for peers in the local network")
+	var stateFile = flag.String("state", "", "save known peers and DHT nodes to this file")
+	var debug = flag.Bool("debug", false, "log every challenge and candidate")
+	var epoch = flag.Duration("epoch", 0, "change the infohash every epoch, e.g. 1h")
+	var metricsAddr = flag.String("metrics", "", "serve Prometheus metrics on this address")
+	var legacyAuth = flag.Bool("legacyauth", false, "answer and accept one-shot challenges of older nodes")
+	var identity = flag.String("identity", "", "keep the key of this node in this file")
+	var knownPeers = flag.String("known", "", "pin the keys of the peers in this file, needs -identity")
 	flag.Parse()
 	if len(flag.Args()) != 2 {
 		log.Fatalln("Usage: discover [options] <app port> <passphrase>")
@@ -55,10 +67,41 @@ func main() {
 	host, port := stunHost.IP(), int(stunHost.Port())
 	log.Printf("External IP/port: %s:%d...", host, port)
 
-	if dis, err := discover.NewDiscoverer(port, appPort, []byte(passphrase)); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+
+	options := []discover.Option{discover.WithLogHandler(handler), discover.WithInfoHashEpoch(*epoch)}
+	if *legacyAuth {
+		options = append(options, discover.WithLegacyAuth())
+	}
+	if *identity != "" {
+		options = append(options, discover.WithIdentityFile(*identity))
+	}
+	if *knownPeers != "" {
+		options = append(options, discover.WithKnownPeersFile(*knownPeers))
+	}
+	if dis, err := discover.NewDiscoverer(port, appPort, []byte(passphrase), options...); err != nil {
 		log.Fatal("could not initialize discoverer", err)
 	} else {
-		dis.FindPeers(1)
+		if *lan {
+			dis.AddBackend(discover.NewLANBackend(port))
+		}
+		dis.StateFile = *stateFile
+		if *metricsAddr != "" {
+			go func() {
+				log.Println(http.ListenAndServe(*metricsAddr, dis.StatsHandler()))
+			}()
+		}
+		if err := dis.Start(ctx); err != nil {
+			log.Fatal("could not start discoverer: ", err)
+		}
+		// DiscoveredPeers is closed when the discoverer stops
 		for p := range dis.DiscoveredPeers {
 			// Peer found!
 			fmt.Println("peer found:", p.String())
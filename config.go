@@ -0,0 +1,377 @@
+package discover
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// configuration
+///////////////////////////////////////////////////////////////////////
+
+// What a Discoverer does, see Config.Mode.
+type Mode int
+
+const (
+	// Announce the services with an application port, answer challenges,
+	// and look for peers.
+	ModeFull Mode = iota
+	// Announce the services and answer challenges, but never verify peers.
+	// For servers that don't need to know about their peers.
+	ModeAnnounceOnly
+	// Look for peers and verify them, but never announce ourselves or
+	// listen for challenges. For clients of the services.
+	ModeLookupOnly
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFull:
+		return "full"
+	case ModeAnnounceOnly:
+		return "announce-only"
+	case ModeLookupOnly:
+		return "lookup-only"
+	}
+	return "unknown"
+}
+
+// Config holds everything that can be tuned in a Discoverer. Start from
+// DefaultConfig, or use NewDiscoverer with some Options.
+type Config struct {
+	// Passphrase and application port of the default service. If AppPort
+	// is not a positive number, we don't announce ourselves as a peer.
+	Passphrase []byte
+	AppPort    int
+
+	// See Discoverer.Mode.
+	Mode Mode
+
+	// Metadata, endpoints and hosts advertised with the default service (see
+	// AuthServer.SetMetadata, SetEndpoints and SetHosts).
+	Metadata  map[string]string
+	Endpoints []Endpoint
+	Hosts     []string
+
+	// Address and port for the TCP and UDP authentication listeners. This
+	// is the port announced in the DHT, so it must be accessible by the
+	// other peers. An empty address listens on all the IPv4 and IPv6
+	// addresses.
+	AuthAddress string
+	AuthPort    int
+	// If true, the authentication server only listens on IPv4 addresses,
+	// even when AuthAddress would accept IPv6 clients too.
+	AuthIPv4Only bool
+
+	// Address and UDP port of the DHT node. As both use UDP, DHTPort must
+	// be different from AuthPort. If 0, AuthPort+1 is used (or any free
+	// port if AuthPort is 0 or 65535). Peers that verified us use our DHT node
+	// for joining the DHT when the bootstrap nodes are unreachable: they
+	// expect it on AuthPort+1, and any other port is advertised to them in
+	// the DHT_ENDPOINT endpoint.
+	DHTAddress string
+	DHTPort    int
+	// If true, we join the IPv6 DHT too (BEP 32).
+	DHTIPv6 bool
+
+	// Time we wait for a response to a challenge, and number of times the
+	// challenge is sent before giving up on a peer.
+	VerifyTimeout time.Duration
+	VerifyRetries int
+
+	// See Discoverer.MinPeers, QueryInterval, ReverifyInterval and
+	// MaxFailures. FastQueryInterval is the time between DHT queries until
+	// MinPeers are found.
+	MinPeers          int
+	FastQueryInterval time.Duration
+	QueryInterval     time.Duration
+	ReverifyInterval  time.Duration
+	MaxFailures       int
+
+	// See Discoverer.Probe and ProbeInterval. A probe taking longer than
+	// ProbeTimeout fails.
+	Probe         Probe
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+
+	// Number and size of the buffers used for reading UDP requests.
+	UDPPoolSize   int
+	UDPBufferSize int
+
+	// DHT nodes used for joining the network (see DHTBackend).
+	BootstrapNodes []string
+	// Scheme used for deriving the infohashes and the keys from the
+	// passphrases: KDF_HKDF, KDF_SCRYPT or KDF_LEGACY. If LegacyKDF is
+	// true, we use KDF_LEGACY too, so nodes of older versions can still find
+	// us and be found; this makes offline attacks on the passphrases easy,
+	// so it should only be used while migrating.
+	KDF       byte
+	LegacyKDF bool
+
+	// Unless LegacyAuth is true, our AuthServer only reveals the application
+	// port and the metadata to clients that prove they know the passphrase,
+	// and our AuthClient only accepts peers that ask for that proof. Older
+	// nodes answer and send one-shot challenges, so it is needed for talking
+	// to them, but it lets anyone who knows a key hint learn our port.
+	LegacyAuth bool
+
+	// If true, peers are verified with a Noise handshake instead of the
+	// challenge and the response, and our AuthServer only answers Noise
+	// handshakes, so what we advertise is always encrypted (see noise.go).
+	// Every peer must use it, as older nodes do not know it. Our AuthClient
+	// only sends the handshakes over UDP, as it does the challenges, although
+	// our AuthServer answers them over TCP too.
+	Noise bool
+
+	// If set, the infohashes of the services change every InfoHashEpoch,
+	// e.g. every hour (see Service). All the peers must use the same epoch.
+	InfoHashEpoch time.Duration
+
+	// See Discoverer.StateFile.
+	StateFile string
+
+	// Key identifying our node (see Peer.ID). If it is nil, it is read from
+	// IdentityFile, which is created if it does not exist; without either, a
+	// new key is used every time we start.
+	Identity     ed25519.PrivateKey
+	IdentityFile string
+	// If set, the keys of the peers are pinned by address in this file the
+	// first time they are seen, and peers presenting another key are
+	// rejected (see PeerRejected). The peers must keep their keys when they
+	// restart, so it needs Identity or IdentityFile, as do their peers.
+	KnownPeersFile string
+
+	// See AuthServer.OnSession.
+	OnSession func(addr string, session *Session)
+
+	// Where discover writes its logs. Every record has a "stage" attribute
+	// (listen, verify, challenge, dht, bootstrap, lan, state), and "peer",
+	// "err" and "kind" (see errorKind) where it makes sense. The per-packet
+	// logs are at the debug level.
+	Logger *slog.Logger
+}
+
+// DefaultConfig returns a configuration with sane defaults for everything but
+// the passphrase.
+func DefaultConfig() Config {
+	return Config{
+		DHTIPv6:           true,
+		VerifyTimeout:     DEFAULT_TIMEOUT * time.Millisecond,
+		VerifyRetries:     DEFAULT_VERIFY_RETRIES,
+		MinPeers:          DEFAULT_MIN_PEERS,
+		FastQueryInterval: DEFAULT_FAST_QUERY_INTERVAL,
+		QueryInterval:     DEFAULT_QUERY_INTERVAL,
+		ReverifyInterval:  DEFAULT_REVERIFY_INTERVAL,
+		MaxFailures:       DEFAULT_MAX_FAILURES,
+		ProbeInterval:     DEFAULT_PROBE_INTERVAL,
+		ProbeTimeout:      DEFAULT_PROBE_TIMEOUT,
+		UDPPoolSize:       LEN_UDP_POOLS,
+		UDPBufferSize:     LEN_UDP_BUF,
+		BootstrapNodes:    DEFAULT_BOOTSTRAP_NODES,
+		KDF:               DEFAULT_KDF,
+		Logger:            slog.Default(),
+	}
+}
+
+// Validate checks the configuration, filling in the DHT port if needed.
+func (c *Config) Validate() error {
+	if len(c.Passphrase) == 0 {
+		return fmt.Errorf("empty passphrase")
+	}
+	if c.AppPort > 65535 {
+		return fmt.Errorf("invalid application port %d", c.AppPort)
+	}
+	if c.Mode < ModeFull || c.Mode > ModeLookupOnly {
+		return fmt.Errorf("invalid mode %d", c.Mode)
+	}
+	if c.Mode == ModeAnnounceOnly && c.AppPort <= 0 {
+		return fmt.Errorf("the %s mode needs an application port", c.Mode)
+	}
+	if c.AuthPort < 0 || c.AuthPort > 65535 {
+		return fmt.Errorf("invalid authentication port %d", c.AuthPort)
+	}
+	if c.DHTPort == 0 && c.AuthPort != 0 && c.AuthPort < 65535 {
+		c.DHTPort = c.AuthPort + 1
+	}
+	if c.DHTPort < 0 || c.DHTPort > 65535 {
+		return fmt.Errorf("invalid DHT port %d", c.DHTPort)
+	}
+	if c.DHTPort != 0 && c.DHTPort == c.AuthPort {
+		return fmt.Errorf("the DHT and the authentication server cannot share UDP port %d", c.DHTPort)
+	}
+	if c.VerifyTimeout <= 0 {
+		return fmt.Errorf("invalid verification timeout %v", c.VerifyTimeout)
+	}
+	if c.VerifyRetries < 1 {
+		return fmt.Errorf("at least one verification attempt is needed")
+	}
+	if c.MinPeers < 0 || c.MaxFailures < 1 {
+		return fmt.Errorf("invalid MinPeers or MaxFailures")
+	}
+	if c.FastQueryInterval <= 0 || c.QueryInterval < c.FastQueryInterval || c.ReverifyInterval <= 0 {
+		return fmt.Errorf("invalid query or reverify intervals")
+	}
+	if c.ProbeInterval <= 0 || c.ProbeTimeout <= 0 {
+		return fmt.Errorf("invalid probe interval or timeout")
+	}
+	if c.UDPPoolSize < 1 || c.UDPBufferSize < LEN_UDP_MIN_BUF {
+		return fmt.Errorf("UDP buffers must be at least %d bytes", LEN_UDP_MIN_BUF)
+	}
+	if c.KDF > KDF_SCRYPT {
+		return ERR_UNKNOWN_KDF
+	}
+	if c.KnownPeersFile != "" && c.Identity == nil && c.IdentityFile == "" {
+		return fmt.Errorf("pinning the keys of the peers needs a persistent identity")
+	}
+	if c.InfoHashEpoch < 0 {
+		return fmt.Errorf("invalid infohash epoch %v", c.InfoHashEpoch)
+	}
+	if c.Logger == nil {
+		return fmt.Errorf("no logger")
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+
+// An Option changes the configuration used by NewDiscoverer.
+type Option func(*Config)
+
+// WithMode sets what the discoverer does.
+func WithMode(mode Mode) Option {
+	return func(c *Config) { c.Mode = mode }
+}
+
+// WithMetadata sets the metadata advertised with the default service.
+func WithMetadata(metadata map[string]string) Option {
+	return func(c *Config) { c.Metadata = metadata }
+}
+
+// WithEndpoints sets the endpoints advertised with the default service.
+func WithEndpoints(endpoints ...Endpoint) Option {
+	return func(c *Config) { c.Endpoints = endpoints }
+}
+
+// WithHosts sets the hosts where the application of the default service can
+// be reached.
+func WithHosts(hosts ...string) Option {
+	return func(c *Config) { c.Hosts = hosts }
+}
+
+// WithAuthAddress sets the address the authentication server listens on.
+func WithAuthAddress(address string) Option {
+	return func(c *Config) { c.AuthAddress = address }
+}
+
+// WithDHT sets the address and port of the DHT node.
+func WithDHT(address string, port int) Option {
+	return func(c *Config) { c.DHTAddress, c.DHTPort = address, port }
+}
+
+// WithIPv4Only makes the DHT node join only the IPv4 DHT, and the
+// authentication server listen on IPv4 addresses only.
+func WithIPv4Only() Option {
+	return func(c *Config) {
+		c.DHTIPv6 = false
+		c.AuthIPv4Only = true
+		if c.AuthAddress == "" {
+			c.AuthAddress = "0.0.0.0"
+		}
+	}
+}
+
+// WithVerify sets the timeout and number of attempts of verifications.
+func WithVerify(timeout time.Duration, retries int) Option {
+	return func(c *Config) { c.VerifyTimeout, c.VerifyRetries = timeout, retries }
+}
+
+// WithMinPeers sets the number of peers we try to find as fast as possible.
+func WithMinPeers(minPeers int) Option {
+	return func(c *Config) { c.MinPeers = minPeers }
+}
+
+// WithQueryIntervals sets the time between DHT queries until MinPeers are
+// found (fast) and after that (steady).
+func WithQueryIntervals(fast, steady time.Duration) Option {
+	return func(c *Config) { c.FastQueryInterval, c.QueryInterval = fast, steady }
+}
+
+// WithReverify sets the time between verifications of known peers, and how
+// many can fail before the peer is expired.
+func WithReverify(interval time.Duration, maxFailures int) Option {
+	return func(c *Config) { c.ReverifyInterval, c.MaxFailures = interval, maxFailures }
+}
+
+// WithProbe sets the health probe of the peers, and the time between probes.
+func WithProbe(probe Probe, interval time.Duration) Option {
+	return func(c *Config) {
+		c.Probe = probe
+		c.ProbeInterval = interval
+	}
+}
+
+// WithUDPBuffers sets the number and size of the UDP buffers.
+func WithUDPBuffers(poolSize, bufferSize int) Option {
+	return func(c *Config) { c.UDPPoolSize, c.UDPBufferSize = poolSize, bufferSize }
+}
+
+// WithBootstrapNodes sets the DHT nodes used for joining the network.
+func WithBootstrapNodes(nodes ...string) Option {
+	return func(c *Config) { c.BootstrapNodes = nodes }
+}
+
+// WithKDF sets the key derivation scheme, and whether KDF_LEGACY is used too.
+func WithKDF(kdf byte, legacy bool) Option {
+	return func(c *Config) {
+		c.KDF = kdf
+		c.LegacyKDF = legacy
+	}
+}
+
+// WithLegacyAuth makes us answer and accept one-shot challenges, without
+// mutual authentication, for talking to older nodes.
+func WithLegacyAuth() Option {
+	return func(c *Config) { c.LegacyAuth = true }
+}
+
+// WithNoise makes us authenticate the peers with Noise handshakes.
+func WithNoise() Option {
+	return func(c *Config) { c.Noise = true }
+}
+
+// WithOnSession makes fn receive the sessions of the clients that verify us.
+func WithOnSession(fn func(addr string, session *Session)) Option {
+	return func(c *Config) { c.OnSession = fn }
+}
+
+// WithInfoHashEpoch makes the infohashes change every epoch.
+func WithInfoHashEpoch(epoch time.Duration) Option {
+	return func(c *Config) { c.InfoHashEpoch = epoch }
+}
+
+// WithIdentityFile sets the file where the key of our node is kept.
+func WithIdentityFile(path string) Option {
+	return func(c *Config) { c.IdentityFile = path }
+}
+
+// WithKnownPeersFile sets the file where the keys of the peers are pinned.
+func WithKnownPeersFile(path string) Option {
+	return func(c *Config) { c.KnownPeersFile = path }
+}
+
+// WithStateFile sets the file where the state is saved.
+func WithStateFile(path string) Option {
+	return func(c *Config) { c.StateFile = path }
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithLogHandler sets a logger writing to handler.
+func WithLogHandler(handler slog.Handler) Option {
+	return func(c *Config) { c.Logger = slog.New(handler) }
+}
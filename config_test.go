@@ -0,0 +1,81 @@
+package discover
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := DefaultConfig()
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for an empty passphrase, got nil")
+	}
+
+	c.Passphrase = []byte("secret")
+	c.AuthPort = 40000
+	if err := c.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if c.DHTPort != 40001 {
+		t.Errorf("Wanted DHT port 40001, got %d", c.DHTPort)
+	}
+
+	c.DHTPort = c.AuthPort
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for a shared UDP port, got nil")
+	}
+
+	// there is no port after 65535, so any free one is used
+	c.AuthPort, c.DHTPort = 65535, 0
+	if err := c.Validate(); err != nil {
+		t.Errorf("validate with the last port: %v", err)
+	}
+	if c.DHTPort != 0 {
+		t.Errorf("Wanted a free DHT port, got %d", c.DHTPort)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	d, err := NewDiscoverer(0, 3000, []byte("secret"),
+		WithVerify(time.Second, 3),
+		WithQueryIntervals(time.Second, time.Hour),
+		WithBootstrapNodes("127.0.0.1:6881"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.AuthClient.Timeout != 1000 || d.AuthClient.Retries != 3 {
+		t.Errorf("Verify options not applied to the client: %+v", d.AuthClient)
+	}
+	if d.QueryInterval != time.Hour || len(d.DHT().BootstrapNodes) != 1 {
+		t.Errorf("Query options not applied")
+	}
+
+	if _, err := NewDiscoverer(0, 3000, []byte("secret"), WithUDPBuffers(1, 10)); err == nil {
+		t.Errorf("Expected an error for tiny UDP buffers, got nil")
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	c := DefaultConfig()
+	WithLogHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))(&c)
+
+	server := newAuthServer("127.0.0.1:0", 3000, []byte("secret"), &c)
+	startServer(t, server)
+	client, _ := NewAuthClient(3000, []byte("other secret"))
+	client.Retries = 1
+	if _, err := client.Verify(server.Addr().String()); err == nil {
+		t.Errorf("Expected a verification error, got nil")
+	}
+	// wait for the handlers to finish
+	server.Close()
+
+	for _, want := range []string{"stage=challenge", "kind=unknown_key", "peer=127.0.0.1:"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%q not found in the logs:\n%s", want, buf.String())
+		}
+	}
+}
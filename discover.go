@@ -15,29 +15,72 @@
 package discover
 
 import (
-	"crypto/sha1"
-	"crypto/sha256"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
-
-	"github.com/nictuku/dht"
 )
 
-const DEFAULT_DHT_NODE = "213.239.195.138:40000"
-
 /////////////////////////////////////////////////////////////////////////
 
+// A verified sibling peer.
 type Peer struct {
-	Addr string
+	Service  string // name of the service the peer belongs to
+	Addr     string // address of the peer's application (host:port)
+	AuthAddr string // address where the peer answers our challenges
+	Port     uint16 // advertised application port
+
+	// Stable ID of the peer's node, derived from its public key, which
+	// stays the same when its address changes. Peers of older versions have
+	// neither.
+	ID        string
+	PublicKey ed25519.PublicKey
+
+	// Metadata, endpoints and hosts advertised by the peer, authenticated
+	// like the port. They must not be modified. If the peer advertises hosts,
+	// the first one is used in Addr instead of the address it answered from.
+	Metadata  map[string]string
+	Endpoints []Endpoint
+	Hosts     []string
+
+	FirstSeen    time.Time // first successful verification
+	LastVerified time.Time // last successful verification
+	Failures     int       // failed verifications since the last successful one
+
+	// False if the application of the peer failed its last health probe.
+	// Always true without Discoverer.Probe.
+	Healthy bool
+
+	// Secret shared with the peer by its last verification, if it was
+	// mutual (see Session). It changes with every verification.
+	Session *Session
 }
 
 func (p Peer) String() string {
 	return fmt.Sprintf("%v", p.Addr)
 }
 
+// normalizeAddr returns a host:port address with IPv4-mapped IPv6 addresses
+// (::ffff:1.2.3.4) turned into plain IPv4 addresses, so the same peer is
+// always found under the same address.
+func normalizeAddr(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.JoinHostPort(ip.Unmap().String(), port)
+	}
+	return address
+}
+
 /////////////////////////////////////////////////////////////////////////
 
 // A discoverer uses the BitTorrent DHT network to find sibling
@@ -48,60 +91,162 @@ func (p Peer) String() string {
 // Wherez will try aggressively to find at least minPeers as fast as possible.
 //
 // The passphrase will be used to authenticate remote peers. This wherez node
-// will keep running indefinitely as a DHT node.
+// will keep running as a DHT node until it is stopped.
 //
 // If appPort is a positive number, wherez will advertise that our main application
 // is on port appPort of the current host. If it's negative, it doesn't
 // announce itself as a peer.
+//
+// More services, with their own passphrases and application ports, can be
+// added with AddService. They all share the same DHT node and port.
+//
+// Candidate peers are found by the DHT backend, and by any other backend added
+// with AddBackend.
+//
+// Everything else can be tuned with a Config, see NewDiscovererConfig.
 type Discoverer struct {
-	port            int
-	appPort         int
-	passphrase      []byte
-	DiscoveredPeers chan Peer
-	ih              dht.InfoHash
+	config          Config
+	logger          *slog.Logger
+	DiscoveredPeers chan Peer // verified peers of the default service, see Start
+	services        []*Service
+	backends        []Backend
+	dht             *DHTBackend
+
+	// What the discoverer does: announce and look for peers (ModeFull), only
+	// announce (ModeAnnounceOnly) or only look for peers (ModeLookupOnly). It
+	// must be set before Start.
+	Mode Mode
+
+	// Minimum number of verified peers we want to know. Until they are found,
+	// the DHT is queried every Config.FastQueryInterval.
+	MinPeers int
+	// Steady-state time between DHT queries once MinPeers have been found.
+	QueryInterval time.Duration
+
+	// Time between verifications of the known peers. A peer is expired after
+	// MaxFailures failed verifications in a row.
+	ReverifyInterval time.Duration
+	MaxFailures      int
+
+	// If set, the application of a peer must pass this probe after the peer
+	// is verified, before it is sent to DiscoveredPeers. Known peers are
+	// probed again every ProbeInterval, and marked as not Healthy while they
+	// fail, instead of being removed.
+	Probe         Probe
+	ProbeInterval time.Duration
+
+	// If set, good DHT nodes and verified peers are saved to this file
+	// periodically and on Stop. On Start, the peers saved are verified again
+	// right away, while the DHT warms up.
+	StateFile string
+
+	events  chan PeerEvent // nil unless Events has been called
+	metrics *metrics       // shared with the AuthServer
+	known   *knownPeers    // nil without Config.KnownPeersFile
+
+	cachedMu sync.Mutex
+	cached   []statePeer // peers from the state file not verified yet
+
+	inFlightMu sync.Mutex
+	inFlight   map[string]struct{} // candidates being verified
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when Stop has finished
+	stopErr error
+	wg      sync.WaitGroup // background goroutines
 
 	*AuthClient
 	*AuthServer
 }
 
-// create a new servie
-func NewDiscoverer(port int, appPort int, passphrase []byte) (*Discoverer, error) {
-	// infohash used for this wherez lookup. This should be somewhat hard to guess
-	// but it's not exactly a secret.
-
-	// SHA256 of the passphrase.
-	h256 := sha256.New()
-	h256.Write(passphrase)
-	h := h256.Sum(nil)
-
-	// Assuming perfect rainbow databases, it's better if the infohash does not
-	// give out too much about the passphrase. Take half of this hash, then
-	// generate a SHA1 hash from it.
-	h2 := h[0 : sha256.Size/2]
+// create a new servie, authenticating peers on port and running the DHT node
+// on the next one. The defaults can be changed with options.
+func NewDiscoverer(port int, appPort int, passphrase []byte, options ...Option) (*Discoverer, error) {
+	config := DefaultConfig()
+	config.AuthPort = port
+	config.AppPort = appPort
+	config.Passphrase = passphrase
+	for _, option := range options {
+		option(&config)
+	}
+	return NewDiscovererConfig(config)
+}
 
-	// Mainline DHT uses sha1.
-	h160 := sha1.New()
-	h160.Write(h2)
-	h3 := h160.Sum(nil)
-	ih := dht.InfoHash(h3[:])
+// create a new service from a configuration. The configuration is validated
+// first.
+func NewDiscovererConfig(config Config) (*Discoverer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
 
-	listenAddress := net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
+	if config.Identity == nil {
+		if config.IdentityFile != "" {
+			identity, err := loadIdentity(config.IdentityFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load the identity: %v", err)
+			}
+			config.Identity = identity
+		} else if _, identity, err := ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		} else {
+			config.Identity = identity
+		}
+	}
+	var known *knownPeers
+	if config.KnownPeersFile != "" {
+		var err error
+		if known, err = loadKnownPeers(config.KnownPeersFile); err != nil {
+			return nil, fmt.Errorf("could not load the known peers: %v", err)
+		}
+	}
 
-	authServer, sErr := NewAuthServer(listenAddress, appPort, passphrase)
-	if sErr != nil {
-		return nil, sErr
+	listenAddress := net.JoinHostPort(config.AuthAddress, strconv.Itoa(config.AuthPort))
+	authServer := newAuthServer(listenAddress, config.AppPort, config.Passphrase, &config)
+	if err := authServer.SetMetadata(config.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
 	}
-	authClient, cErr := NewAuthClient(appPort, passphrase)
-	if cErr != nil {
-		return nil, cErr
+	if err := authServer.SetEndpoints(advertisedEndpoints(config.Endpoints, config.AuthPort, config.DHTPort)); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if err := authServer.SetHosts(config.Hosts); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	authClient := newAuthClient(config.AppPort, config.Passphrase, &config)
+	metrics := newMetrics()
+	authServer.metrics = metrics
+
+	service, err := newService(DEFAULT_SERVICE, config.AppPort, config.Passphrase, &config)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive the keys: %v", err)
 	}
+	dhtBackend := NewDHTBackend(config.DHTPort)
+	dhtBackend.Address = config.DHTAddress
+	dhtBackend.IPv6 = config.DHTIPv6
+	dhtBackend.BootstrapNodes = config.BootstrapNodes
+	dhtBackend.setLogger(config.Logger)
 
 	d := &Discoverer{
-		port:            port,
-		appPort:         appPort,
-		passphrase:      passphrase,
-		DiscoveredPeers: make(chan Peer),
-		ih:              ih,
+		config:           config,
+		logger:           config.Logger,
+		DiscoveredPeers:  service.DiscoveredPeers,
+		services:         []*Service{service},
+		backends:         []Backend{dhtBackend},
+		dht:              dhtBackend,
+		inFlight:         make(map[string]struct{}),
+		Mode:             config.Mode,
+		MinPeers:         config.MinPeers,
+		QueryInterval:    config.QueryInterval,
+		ReverifyInterval: config.ReverifyInterval,
+		MaxFailures:      config.MaxFailures,
+		Probe:            config.Probe,
+		ProbeInterval:    config.ProbeInterval,
+		StateFile:        config.StateFile,
+		done:             make(chan struct{}),
+		metrics:          metrics,
+		known:            known,
 
 		AuthServer: authServer,
 		AuthClient: authClient,
@@ -110,63 +255,698 @@ func NewDiscoverer(port int, appPort int, passphrase []byte) (*Discoverer, error
 	return d, nil
 }
 
-// find authenticated peers
-func (this *Discoverer) FindPeers(minPeers int) {
-	defer close(this.DiscoveredPeers)
-
-	if this.appPort > 0 {
-		if err := this.ListenAndServe(); err != nil {
-			log.Fatalf("Could not open listener:", err)
-			return
+// AddService registers another service that will be announced and looked for
+// along with the default one, with its own passphrase and application port.
+// Its peers are sent to the DiscoveredPeers channel of the returned Service.
+// It must be called before Start.
+func (this *Discoverer) AddService(name string, appPort int, passphrase []byte) (*Service, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopped {
+		return nil, ERR_STOPPED
+	}
+	if this.started {
+		return nil, ERR_ALREADY_STARTED
+	}
+	for _, s := range this.services {
+		if s.Name == name {
+			return nil, fmt.Errorf("service %q already exists", name)
 		}
 	}
 
-	// Connect to the DHT network
-	log.Println("Connecting to DHT network...")
-	dhtService, err := dht.New(
-		&dht.Config{
-			Port: this.port,
-		})
+	if this.Mode == ModeAnnounceOnly && appPort <= 0 {
+		return nil, fmt.Errorf("the %s mode needs an application port", this.Mode)
+	}
+	service, err := newService(name, appPort, passphrase, &this.config)
 	if err != nil {
-		log.Println("Could not create the DHT node:", err)
+		return nil, fmt.Errorf("could not derive the keys: %v", err)
+	}
+	if service.announced() {
+		if err := this.AuthServer.AddKey(passphrase, appPort); err != nil {
+			return nil, err
+		}
+		if endpoints := advertisedEndpoints(nil, this.config.AuthPort, this.config.DHTPort); len(endpoints) > 0 {
+			if err := this.AuthServer.SetKeyEndpoints(passphrase, endpoints); err != nil {
+				return nil, err
+			}
+		}
+	}
+	this.services = append(this.services, service)
+	return service, nil
+}
+
+// returns the endpoints advertised with the responses: endpoints, and dhtPort
+// if the peers cannot guess it from authPort (see Config.DHTPort). A port of 0
+// is not known yet.
+func advertisedEndpoints(endpoints []Endpoint, authPort, dhtPort int) []Endpoint {
+	if dhtPort == 0 || dhtPort == authPort+1 {
+		return endpoints
+	}
+	return append(slices.Clone(endpoints), Endpoint{Name: DHT_ENDPOINT, Protocol: "udp", Port: uint16(dhtPort)})
+}
+
+// advertises the ports our authentication server and DHT node actually
+// bound, which are random when configured as 0
+func (this *Discoverer) advertiseDHTPort() {
+	addr, ok := this.AuthServer.Addr().(*net.UDPAddr)
+	if !ok {
 		return
 	}
+	if err := this.AuthServer.SetEndpoints(advertisedEndpoints(this.config.Endpoints, addr.Port, this.dht.Port())); err != nil {
+		this.logger.Warn("could not advertise the DHT port", "stage", "listen", "err", err)
+	}
+	for _, s := range this.services[1:] {
+		if !s.announced() {
+			continue
+		}
+		if err := this.AuthServer.SetKeyEndpoints(s.passphrase, advertisedEndpoints(nil, addr.Port, this.dht.Port())); err != nil {
+			this.logger.Warn("could not advertise the DHT port", "stage", "listen", "service", s.Name, "err", err)
+		}
+	}
+}
+
+// DHT returns the DHT backend, e.g. for changing its bootstrap nodes before
+// Start.
+func (this *Discoverer) DHT() *DHTBackend {
+	return this.dht
+}
+
+// AddBackend adds another source of candidate peers. It must be called
+// before Start.
+func (this *Discoverer) AddBackend(b Backend) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopped {
+		return ERR_STOPPED
+	}
+	if this.started {
+		return ERR_ALREADY_STARTED
+	}
+	if lb, ok := b.(loggingBackend); ok {
+		lb.setLogger(this.logger)
+	}
+	this.backends = append(this.backends, b)
+	return nil
+}
+
+// Services returns the services registered in this discoverer, starting with
+// the default one.
+func (this *Discoverer) Services() []*Service {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]*Service(nil), this.services...)
+}
 
-	log.Printf("Adding DHT node %s...", DEFAULT_DHT_NODE)
-	dhtService.AddNode(DEFAULT_DHT_NODE)
-
-	dhtService.Start()
-
-	// obtins peers (that can authenticate) from the DHT network
-	go func(d *dht.DHT) {
-		log.Printf("Waiting for possible peers...")
-		for r := range d.PeersRequestResults {
-			for _, peers := range r {
-				for _, x := range peers {
-					// A DHT peer for our infohash was found. It
-					// needs to be authenticated.
-					address := dht.DecodePeerAddress(x)
-					log.Printf("Discovered possible peer %s", address)
-					if response, err := this.Verify(address); err != nil || response == nil {
-						log.Printf("Verification error: %s", err.Error())
-					} else {
-						host, _, err := net.SplitHostPort(address)
-						if err != nil {
-							log.Printf("could not parse address %s: %v", address, err)
-						} else {
-							peer := Peer{Addr: fmt.Sprintf("%v:%v", host, response.Port)}
-							this.DiscoveredPeers <- peer
+// Start joins the DHT network (and any other backend) and starts looking for
+// authenticated peers in the background, sending them to DiscoveredPeers. The
+// discoverer keeps running until ctx is cancelled or Stop is called.
+//
+// Every peer is sent once to DiscoveredPeers. The channel is buffered and
+// never blocks discovery: peers that do not fit are only logged, so
+// applications using Peers or Events can ignore it.
+//
+// In ModeAnnounceOnly, nothing is ever sent to DiscoveredPeers. In
+// ModeLookupOnly, we don't listen for challenges.
+//
+// If Start fails, the discoverer is stopped, as its listeners cannot be
+// opened again.
+func (this *Discoverer) Start(ctx context.Context) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stopped {
+		return ERR_STOPPED
+	}
+	if this.started {
+		return ERR_ALREADY_STARTED
+	}
+	for _, s := range this.services {
+		s.lookupOnly = this.Mode == ModeLookupOnly
+	}
+
+	// we only need to answer challenges if we announce some service
+	for _, s := range this.services {
+		if s.announced() {
+			if err := this.ListenAndServe(); err != nil {
+				this.abortStart()
+				return fmt.Errorf("could not open listener: %v", err)
+			}
+			// announce the port we are actually listening on
+			this.dht.AnnouncePort = this.AuthServer.Addr().(*net.UDPAddr).Port
+			for _, b := range this.backends {
+				if mb, ok := b.(multicastBackend); ok {
+					for _, group := range mb.multicastGroups() {
+						if err := this.JoinMulticast(group); err != nil {
+							this.logger.Warn("LAN discovery will not work", "stage", "listen", "err", err)
 						}
 					}
 				}
 			}
+			break
+		}
+	}
+
+	if this.StateFile != "" {
+		if st, err := loadState(this.StateFile); err != nil {
+			this.logger.Warn("could not load state", "stage", "state", "file", this.StateFile, "err", err)
+		} else {
+			this.dht.SetNodes(st.Nodes)
+			this.cached = st.Peers
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	candidates := make(chan Candidate, LEN_CANDIDATES)
+	for i, b := range this.backends {
+		if err := b.Start(ctx, this.services, candidates); err != nil {
+			cancel()
+			for _, started := range this.backends[:i] {
+				started.Stop()
+			}
+			this.abortStart()
+			return fmt.Errorf("could not start the %s backend: %v", b.Name(), err)
+		}
+	}
+	this.advertiseDHTPort()
+
+	this.cancel = cancel
+	this.started = true
+
+	if this.Mode == ModeAnnounceOnly {
+		this.wg.Add(1)
+		go this.discardCandidates(ctx, candidates)
+	} else {
+		this.wg.Add(2)
+		go this.verifyPeers(ctx, candidates)
+		go this.reverifyPeers(ctx)
+		if this.Probe != nil {
+			this.wg.Add(1)
+			go this.probePeers(ctx)
+		}
+		if this.StateFile != "" {
+			this.wg.Add(1)
+			go this.verifyCachedPeers(ctx)
+		}
+	}
+	if this.StateFile != "" {
+		this.wg.Add(1)
+		go this.saveStatePeriodically(ctx)
+	}
+	for _, s := range this.services {
+		this.wg.Add(1)
+		go this.queryPeers(ctx, s)
+	}
+
+	// stop everything when the parent context is cancelled
+	go func() {
+		<-ctx.Done()
+		this.Stop()
+	}()
+
+	return nil
+}
+
+// Stop stops the backends, closes the authentication listeners, waits
+// for the requests in progress and closes the DiscoveredPeers channels. It can be called
+// more than once: later calls wait for the first one and return its result.
+func (this *Discoverer) Stop() error {
+	this.mu.Lock()
+	if this.stopped {
+		this.mu.Unlock()
+		<-this.done
+		return this.stopErr
+	}
+	this.stopped = true
+	started := this.started
+	this.mu.Unlock()
+
+	if started {
+		this.cancel()
+		for _, b := range this.backends {
+			if err := b.Stop(); err != nil && this.stopErr == nil {
+				this.stopErr = err
+			}
 		}
-	}(dhtService) // sends authenticated peers to channel c.
+		if err := this.AuthServer.Close(); err != nil && this.stopErr == nil {
+			this.stopErr = err
+		}
+		this.wg.Wait()
+		if this.StateFile != "" {
+			if err := this.saveState(); err != nil && this.stopErr == nil {
+				this.stopErr = err
+			}
+		}
+	}
+	this.mu.Lock()
+	this.closeChannels()
+	this.mu.Unlock()
+	close(this.done)
+	return this.stopErr
+}
+
+// stops a discoverer whose Start has failed. It must be called with mu held.
+func (this *Discoverer) abortStart() {
+	this.AuthServer.Close()
+	this.stopped = true
+	this.closeChannels()
+	close(this.done)
+}
 
+// closes the channels the application reads from. It must be called with mu
+// held.
+func (this *Discoverer) closeChannels() {
+	for _, s := range this.services {
+		close(s.DiscoveredPeers)
+	}
+	if this.events != nil {
+		close(this.events)
+	}
+}
+
+// Run starts the discoverer and blocks until ctx is cancelled or Stop is
+// called.
+func (this *Discoverer) Run(ctx context.Context) error {
+	if err := this.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-this.done:
+	}
+	return this.Stop()
+}
+
+// ID returns the ID of our node, as our peers see it in Peer.ID.
+func (this *Discoverer) ID() string {
+	return nodeID(this.AuthServer.Identity.Public().(ed25519.PublicKey))
+}
+
+// checks the key of the peer at address against the one pinned for it. The
+// impostors are reported with a PeerRejected event.
+func (this *Discoverer) checkKey(ctx context.Context, s *Service, address string, response *Response) error {
+	if this.known == nil {
+		return nil
+	}
+	err := this.known.check(address, response.PublicKey)
+	if err == ERR_KEY_MISMATCH {
+		this.logger.Warn("peer presented another key than the known one", "stage", "verify", "service", s.Name, "peer", address, "id", nodeID(response.PublicKey))
+		this.sendEvent(ctx, PeerEvent{Type: PeerRejected, Peer: Peer{
+			Service:   s.Name,
+			AuthAddr:  address,
+			Port:      response.Port,
+			ID:        nodeID(response.PublicKey),
+			PublicKey: response.PublicKey,
+		}})
+		return err
+	} else if err != nil {
+		this.logger.Warn("could not save the known peers", "stage", "verify", "err", err)
+	}
+	return nil
+}
+
+// Peers returns a snapshot of the verified peers we currently know, for all
+// the services.
+func (this *Discoverer) Peers() []Peer {
+	var peers []Peer
+	for _, s := range this.Services() {
+		peers = append(peers, s.Peers()...)
+	}
+	return peers
+}
+
+// Events returns a channel where joins, departures and updates of peers are
+// reported. It must be called before Start, and the channel must be consumed
+// as discovery is paused while an event is pending. It is closed by Stop.
+func (this *Discoverer) Events() <-chan PeerEvent {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.events == nil {
+		this.events = make(chan PeerEvent, LEN_EVENTS)
+		if this.stopped {
+			close(this.events)
+		}
+	}
+	return this.events
+}
+
+// find authenticated peers, trying to find at least minPeers as fast as
+// possible. It blocks until the discoverer is stopped.
+//
+// Deprecated: set MinPeers and use Start or Run.
+func (this *Discoverer) FindPeers(minPeers int) error {
+	this.MinPeers = minPeers
+	return this.Run(context.Background())
+}
+
+// verifies the candidates found by the backends and sends them to the
+// DiscoveredPeers channel of their service. Up to MAX_PARALLEL_VERIFY
+// candidates are verified at the same time.
+func (this *Discoverer) verifyPeers(ctx context.Context, candidates <-chan Candidate) {
+	defer this.wg.Done()
+
+	sem := make(chan struct{}, MAX_PARALLEL_VERIFY)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-candidates:
+			this.metrics.candidate(c.Source)
+			// the same candidate can be found by several backends
+			c.Addr = normalizeAddr(c.Addr)
+			key := c.Service.Name + "/" + c.Addr
+			this.inFlightMu.Lock()
+			_, found := this.inFlight[key]
+			this.inFlight[key] = struct{}{}
+			this.inFlightMu.Unlock()
+			if found {
+				continue
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			this.wg.Add(1)
+			go func(c Candidate, key string) {
+				defer this.wg.Done()
+				defer func() { <-sem }()
+				this.verifyCandidate(ctx, c.Service, c.Addr)
+
+				this.inFlightMu.Lock()
+				delete(this.inFlight, key)
+				this.inFlightMu.Unlock()
+			}(c, key)
+		}
+	}
+}
+
+// throws away the candidates found by the backends, in ModeAnnounceOnly
+func (this *Discoverer) discardCandidates(ctx context.Context, candidates <-chan Candidate) {
+	defer this.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-candidates:
+			this.metrics.candidate(c.Source)
+		}
+	}
+}
+
+// authenticates a possible peer found by a backend, unless it is a known peer
+// that we have verified recently.
+func (this *Discoverer) verifyCandidate(ctx context.Context, s *Service, address string) {
+	if s.peers.verifiedSince(address, time.Now().Add(-this.ReverifyInterval)) {
+		return
+	}
+	this.verifyPeer(ctx, s, address)
+}
+
+// authenticates a peer of a service and records it in its peer table. New
+// peers are sent to the DiscoveredPeers channel of the service.
+func (this *Discoverer) verifyPeer(ctx context.Context, s *Service, address string) {
+	start := time.Now()
+	response, err := this.verify(address, s.passphrase)
+	this.metrics.verification(err, time.Since(start))
+	if err != nil || response == nil {
+		this.logger.Debug("verification failed", "stage", "verify", "service", s.Name, "peer", address, "kind", errorKind(err), "err", err)
+		this.verificationFailed(ctx, s, address)
+	} else if err := this.checkKey(ctx, s, address, response); err != nil {
+		this.verificationFailed(ctx, s, address)
+	} else {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			this.logger.Warn("could not parse address", "stage", "verify", "peer", address, "err", err)
+		} else {
+			if len(response.Hosts) > 0 {
+				host = response.Hosts[0]
+			}
+			peer := Peer{
+				Service:   s.Name,
+				Addr:      net.JoinHostPort(host, strconv.Itoa(int(response.Port))),
+				Port:      response.Port,
+				ID:        nodeID(response.PublicKey),
+				PublicKey: response.PublicKey,
+				Metadata:  response.Metadata,
+				Endpoints: response.Endpoints,
+				Hosts:     response.Hosts,
+				Session:   response.Session,
+			}
+			// new peers are probed before they are reported, and the
+			// known ones by probePeers
+			if !s.peers.known(address) {
+				peer.Healthy = this.probe(ctx, s, peer)
+			}
+			moved := s.peers.authAddrOf(peer.ID)
+			peer, ev := s.peers.verified(address, peer, time.Now())
+			if moved != "" && moved != address {
+				this.dropped(moved)
+			}
+			this.peerChanged(ctx, s, peer, ev)
+		}
+	}
+}
+
+// reports a change of a peer. Healthy peers are sent to the DiscoveredPeers
+// channel of their service the first time.
+func (this *Discoverer) peerChanged(ctx context.Context, s *Service, peer Peer, ev *PeerEventType) {
+	if ev == nil {
+		return
+	}
+	if s.peers.report(peer.AuthAddr) {
+		this.logger.Info("found a valid peer", "stage", "verify", "service", s.Name, "peer", peer.AuthAddr)
+		select {
+		case s.DiscoveredPeers <- peer:
+		default:
+			this.logger.Warn("DiscoveredPeers is full, peer not sent", "stage", "verify", "service", s.Name, "peer", peer.AuthAddr)
+		}
+	}
+	this.sendEvent(ctx, PeerEvent{Type: *ev, Peer: peer})
+}
+
+// runs the health probe on a peer, if there is one
+func (this *Discoverer) probe(ctx context.Context, s *Service, peer Peer) bool {
+	if this.Probe == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, this.config.ProbeTimeout)
+	defer cancel()
+	err := this.Probe(ctx, peer)
+	this.metrics.probe(err)
+	if err != nil {
+		this.logger.Debug("health probe failed", "stage", "probe", "service", s.Name, "peer", peer.Addr, "err", err)
+		return false
+	}
+	return true
+}
+
+// periodically probes the known peers, until ctx is cancelled
+func (this *Discoverer) probePeers(ctx context.Context) {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.ProbeInterval)
+	defer ticker.Stop()
 	for {
-		// Keeps requesting for the infohash. This is a no-op if the
-		// DHT is satisfied with the number of peers it has found.
-		dhtService.PeersRequest(string(this.ih), true)
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range this.services {
+			for _, peer := range s.peers.snapshot() {
+				if ctx.Err() != nil {
+					return
+				}
+				peer, ev := s.peers.probed(peer.AuthAddr, this.probe(ctx, s, peer))
+				this.peerChanged(ctx, s, peer, ev)
+			}
+		}
 	}
 }
+
+// records a failed verification, expiring the peer if needed
+func (this *Discoverer) verificationFailed(ctx context.Context, s *Service, address string) {
+	peer, removed := s.peers.failed(address, this.MaxFailures)
+	if !s.peers.known(address) {
+		// expired, or never known, e.g. when its key did not match
+		this.dropped(address)
+	}
+	if removed {
+		this.logger.Info("peer stopped answering: expired", "stage", "verify", "service", s.Name, "peer", peer.Addr)
+		this.sendEvent(ctx, PeerEvent{Type: PeerLeft, Peer: peer})
+		if s.peers.healthy() < this.MinPeers {
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// forgets what the AuthClient knows of the peer at address, once no service
+// has it in its peer table
+func (this *Discoverer) dropped(address string) {
+	for _, s := range this.services {
+		if s.peers.known(address) {
+			return
+		}
+	}
+	this.forget(address)
+}
+
+// sends an event to the Events channel, if anybody is listening
+func (this *Discoverer) sendEvent(ctx context.Context, ev PeerEvent) {
+	this.mu.Lock()
+	events := this.events
+	this.mu.Unlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// periodically verifies the known peers again, until ctx is cancelled
+func (this *Discoverer) reverifyPeers(ctx context.Context) {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.ReverifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range this.services {
+			for _, peer := range s.peers.snapshot() {
+				if ctx.Err() != nil {
+					return
+				}
+				this.verifyPeer(ctx, s, peer.AuthAddr)
+			}
+		}
+	}
+}
+
+// keeps asking the backends for candidates of a service until ctx is
+// cancelled, following the schedule from the scheduler. In ModeAnnounceOnly,
+// we only query the DHT, to announce ourselves every QueryInterval.
+func (this *Discoverer) queryPeers(ctx context.Context, s *Service) {
+	defer this.wg.Done()
+
+	sched := newScheduler(this.MinPeers, this.config.FastQueryInterval, this.QueryInterval)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+		if this.Mode == ModeAnnounceOnly {
+			if s.announced() {
+				this.dht.Lookup(s)
+				this.metrics.lookup(this.dht.Name())
+			}
+			timer.Reset(this.QueryInterval)
+			continue
+		}
+		for _, b := range this.backends {
+			b.Lookup(s)
+			this.metrics.lookup(b.Name())
+		}
+		timer.Reset(sched.next(s.peers.healthy()))
+	}
+}
+
+// verifies the peers from the state file, without waiting for the backends
+func (this *Discoverer) verifyCachedPeers(ctx context.Context) {
+	defer this.wg.Done()
+
+	this.cachedMu.Lock()
+	cached := this.cached
+	this.cachedMu.Unlock()
+
+	byName := make(map[string]*Service)
+	for _, s := range this.services {
+		byName[s.Name] = s
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MAX_PARALLEL_VERIFY)
+	for _, p := range cached {
+		s, found := byName[p.Service]
+		if !found || time.Since(p.LastSeen) > MAX_STATE_PEER_AGE {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(s *Service, address string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			this.verifyCandidate(ctx, s, address)
+		}(s, normalizeAddr(p.AuthAddr))
+	}
+	wg.Wait()
+
+	this.cachedMu.Lock()
+	this.cached = nil
+	this.cachedMu.Unlock()
+}
+
+// saves the state file every DEFAULT_SAVE_INTERVAL, until ctx is cancelled
+func (this *Discoverer) saveStatePeriodically(ctx context.Context) {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(DEFAULT_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := this.saveState(); err != nil {
+				this.logger.Warn("could not save state", "stage", "state", "file", this.StateFile, "err", err)
+			}
+		}
+	}
+}
+
+// saves the good DHT nodes and the verified peers to the state file. Cached
+// peers that have not been verified yet are kept.
+func (this *Discoverer) saveState() error {
+	st := &state{Nodes: this.dht.Nodes()}
+	saved := make(map[string]bool)
+	for _, s := range this.Services() {
+		for _, p := range s.Peers() {
+			st.Peers = append(st.Peers, statePeer{
+				Service:  s.Name,
+				AuthAddr: p.AuthAddr,
+				Addr:     p.Addr,
+				Port:     p.Port,
+				LastSeen: p.LastVerified,
+			})
+			saved[s.Name+"/"+p.AuthAddr] = true
+		}
+	}
+
+	this.cachedMu.Lock()
+	for _, p := range this.cached {
+		if !saved[p.Service+"/"+p.AuthAddr] {
+			st.Peers = append(st.Peers, p)
+		}
+	}
+	this.cachedMu.Unlock()
+
+	return st.save(this.StateFile)
+}
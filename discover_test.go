@@ -1,19 +1,530 @@
 package discover
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func DisabledTestFindPeers(t *testing.T) {
 	d, err := NewDiscoverer(60000, 31337, []byte("wherezexample"))
 	if err != nil {
-		t.Fail()
+		t.Fatal(err)
 	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
 
-	c := FindPeers(1)
-	for p := range c {
+	for p := range d.DiscoveredPeers {
 		t.Logf("Found %v", p.String())
 		return
 	}
 }
+
+func TestStartStop(t *testing.T) {
+	d, err := NewDiscoverer(0, 31337, []byte("wherezexample"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := d.Start(ctx); err != ERR_ALREADY_STARTED {
+		t.Errorf("Wanted %v on second start, got %v", ERR_ALREADY_STARTED, err)
+	}
+
+	cancel()
+	if err := d.Stop(); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+	if _, ok := <-d.DiscoveredPeers; ok {
+		t.Errorf("DiscoveredPeers was not closed")
+	}
+	// stopping again must not panic
+	d.Stop()
+}
+
+// a backend that cannot start
+type failingBackend struct{}
+
+func (failingBackend) Name() string { return "failing" }
+
+func (failingBackend) Start(ctx context.Context, services []*Service, candidates chan<- Candidate) error {
+	return errors.New("no network")
+}
+
+func (failingBackend) Lookup(s *Service) {}
+
+func (failingBackend) Stop() error { return nil }
+
+func TestStartFailure(t *testing.T) {
+	d, err := NewDiscoverer(0, 31337, []byte("wherezexample"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBackend(failingBackend{})
+	if err := d.Start(context.Background()); err == nil {
+		t.Fatalf("Expected an error starting a failing backend, got nil")
+	}
+
+	// the listeners were closed, and cannot be opened again
+	if err := d.Start(context.Background()); err != ERR_STOPPED {
+		t.Errorf("Wanted %v on second start, got %v", ERR_STOPPED, err)
+	}
+	if err := d.AuthServer.ListenAndServe(); err != ERR_SERVER_CLOSED {
+		t.Errorf("Wanted %v, got %v", ERR_SERVER_CLOSED, err)
+	}
+	d.Stop()
+	if _, ok := <-d.DiscoveredPeers; ok {
+		t.Errorf("DiscoveredPeers was not closed")
+	}
+}
+
+func TestStaticBackend(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same address twice must be reported once
+	d.AddBackend(NewStaticBackend(server.Addr().String(), server.Addr().String()))
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	select {
+	case p := <-d.DiscoveredPeers:
+		if p.Port != 3000 || p.AuthAddr != server.Addr().String() {
+			t.Errorf("Unexpected peer %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found")
+	}
+	if peers := d.Peers(); len(peers) != 1 {
+		t.Errorf("Wanted 1 peer, got %v", peers)
+	}
+}
+
+func TestStaticBackendStop(t *testing.T) {
+	b := NewStaticBackend("192.0.2.1:4000", "192.0.2.2:4000")
+	candidates := make(chan Candidate)
+	if err := b.Start(context.Background(), nil, candidates); err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads the candidates
+	b.Lookup(&Service{Name: DEFAULT_SERVICE})
+
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop blocked by a lookup")
+	}
+	select {
+	case c := <-candidates:
+		t.Errorf("Candidate %+v sent after Stop", c)
+	default:
+	}
+}
+
+func TestAdvertisedHosts(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	if err := server.SetHosts([]string{"app.example.com", "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetHosts([]string{"app.example.com:80"}); err == nil {
+		t.Errorf("Expected an error for a host with a port, got nil")
+	}
+	startServer(t, server)
+
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBackend(NewStaticBackend(server.Addr().String()))
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	select {
+	case p := <-d.DiscoveredPeers:
+		if p.Addr != "app.example.com:3000" || p.AuthAddr != server.Addr().String() || len(p.Hosts) != 2 {
+			t.Errorf("Unexpected peer %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found")
+	}
+}
+
+func TestAdvertisedDHTPort(t *testing.T) {
+	allowSelf(t)
+	// both ports are random, so the DHT port cannot be guessed
+	passphrase := []byte("wherezexample")
+	d, err := NewDiscoverer(0, 31337, passphrase, WithBootstrapNodes(), WithAuthAddress("127.0.0.1"), WithDHT("127.0.0.1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	client, _ := NewAuthClient(31337, passphrase)
+	response, err := client.Verify(d.AuthServer.Addr().String())
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	p := Peer{AuthAddr: d.AuthServer.Addr().String(), Endpoints: response.Endpoints}
+	if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(d.dht.Port())); peerDHTAddr(p) != want {
+		t.Errorf("Wanted DHT address %s, got %q", want, peerDHTAddr(p))
+	}
+}
+
+func TestIPv4Only(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback")
+	} else {
+		l.Close()
+	}
+
+	d, err := NewDiscoverer(0, 31337, []byte("wherezexample"), WithBootstrapNodes(), WithIPv4Only())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	port := strconv.Itoa(d.AuthServer.Addr().(*net.UDPAddr).Port)
+	if conn, err := net.DialTimeout("tcp6", net.JoinHostPort("::1", port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Connected over IPv6")
+	}
+	// the UDP port is free on IPv6
+	if conn, err := net.ListenPacket("udp6", net.JoinHostPort("::1", port)); err != nil {
+		t.Errorf("UDP listener on IPv6: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestProbe(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	var healthy atomic.Bool
+	probe := func(ctx context.Context, peer Peer) error {
+		if !healthy.Load() {
+			return errors.New("down")
+		}
+		return nil
+	}
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes(), WithProbe(probe, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBackend(NewStaticBackend(server.Addr().String()))
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	select {
+	case p := <-d.DiscoveredPeers:
+		t.Fatalf("Unhealthy peer found: %+v", p)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if peers := d.Peers(); len(peers) != 1 || peers[0].Healthy {
+		t.Fatalf("Expected one unhealthy peer, got %+v", peers)
+	}
+
+	healthy.Store(true)
+	select {
+	case p := <-d.DiscoveredPeers:
+		if !p.Healthy {
+			t.Errorf("Unexpected peer %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found")
+	}
+	if stats := d.Stats(); stats.Probes["ok"] == 0 || stats.Probes["failed"] == 0 {
+		t.Errorf("Unexpected probe stats %v", stats.Probes)
+	}
+}
+
+func TestProbeOnce(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	var probes atomic.Int32
+	probe := func(ctx context.Context, peer Peer) error {
+		probes.Add(1)
+		return nil
+	}
+	// the peer is verified again several times before the next probe
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes(), WithProbe(probe, time.Hour),
+		WithReverify(50*time.Millisecond, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBackend(NewStaticBackend(server.Addr().String()))
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	select {
+	case <-d.DiscoveredPeers:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := probes.Load(); n != 1 {
+		t.Errorf("Wanted 1 probe, got %d", n)
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	var path atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+	}))
+	defer server.Close()
+
+	peer := Peer{Addr: server.Listener.Addr().String()}
+	if err := ProbeHTTP("health")(context.Background(), peer); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if path.Load() != "/health" {
+		t.Errorf("Wanted path /health, got %v", path.Load())
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes(),
+		WithVerify(100*time.Millisecond, 1), WithReverify(100*time.Millisecond, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBackend(NewStaticBackend(server.Addr().String()))
+	events := d.Events()
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.Stop()
+
+	// DiscoveredPeers is never read
+	next := func() PeerEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event")
+		}
+		return PeerEvent{}
+	}
+	if ev := next(); ev.Type != PeerJoined || ev.Peer.Port != 3000 {
+		t.Fatalf("Wanted the peer to join, got %+v", ev)
+	}
+	server.Close()
+	if ev := next(); ev.Type != PeerLeft || ev.Peer.AuthAddr != server.Addr().String() {
+		t.Fatalf("Wanted the peer to leave, got %+v", ev)
+	}
+	if peers := d.Peers(); len(peers) != 0 {
+		t.Errorf("Expired peer still known: %+v", peers)
+	}
+	d.AuthClient.mu.Lock()
+	defer d.AuthClient.mu.Unlock()
+	if _, found := d.AuthClient.wire[server.Addr().String()]; found {
+		t.Errorf("Framing of the expired peer still known")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	st := &state{Peers: []statePeer{{
+		Service:  DEFAULT_SERVICE,
+		AuthAddr: server.Addr().String(),
+		LastSeen: time.Now(),
+	}}}
+	if err := st.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.StateFile = path
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// the cached peer is verified without any backend finding it
+	select {
+	case p := <-d.DiscoveredPeers:
+		if p.Port != 3000 {
+			t.Errorf("Unexpected peer %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found")
+	}
+
+	if err := d.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	st, err = loadState(path)
+	if err != nil || len(st.Peers) != 1 || st.Peers[0].Port != 3000 {
+		t.Errorf("Unexpected state saved %+v, %v", st, err)
+	}
+}
+
+func TestModes(t *testing.T) {
+	if _, err := NewDiscoverer(0, -1, []byte("secret"), WithMode(ModeAnnounceOnly)); err == nil {
+		t.Errorf("Expected an error for announcing without application port, got nil")
+	}
+
+	passphrase := []byte("wherezexample")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+
+	lookup, err := NewDiscoverer(0, 3000, passphrase, WithBootstrapNodes(), WithMode(ModeLookupOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup.AddBackend(NewStaticBackend(server.Addr().String()))
+	if err := lookup.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer lookup.Stop()
+	if lookup.AuthServer.Addr() != nil || lookup.Services()[0].Announced() {
+		t.Errorf("Listening or announcing in the %s mode", lookup.Mode)
+	}
+	select {
+	case <-lookup.DiscoveredPeers:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No peer found in the %s mode", lookup.Mode)
+	}
+
+	announce, err := NewDiscoverer(0, 3000, passphrase, WithBootstrapNodes(), WithMode(ModeAnnounceOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	announce.AddBackend(NewStaticBackend(server.Addr().String()))
+	if err := announce.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer announce.Stop()
+	if announce.AuthServer.Addr() == nil {
+		t.Errorf("Not listening in the %s mode", announce.Mode)
+	}
+	select {
+	case p := <-announce.DiscoveredPeers:
+		t.Errorf("Peer %v verified in the %s mode", p, announce.Mode)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := announce.Stats().Verifications; len(n) != 0 {
+		t.Errorf("Verifications in the %s mode: %v", announce.Mode, n)
+	}
+}
+
+func TestRestartedPeer(t *testing.T) {
+	passphrase := []byte("wherezexample")
+	dir := t.TempDir()
+	knownPeersFile := filepath.Join(dir, "known_peers")
+	if _, err := NewDiscoverer(0, -1, passphrase, WithKnownPeersFile(knownPeersFile)); err == nil {
+		t.Errorf("Expected an error pinning keys without a persistent identity, got nil")
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	allowSelf(t)
+	// the peer restarts with its key, and then with a new one
+	for _, identityFile := range []string{filepath.Join(dir, "peer.pem"), filepath.Join(dir, "peer.pem"), ""} {
+		peer, err := NewDiscoverer(port, 3000, passphrase, WithBootstrapNodes(), WithMode(ModeAnnounceOnly),
+			WithAuthAddress("127.0.0.1"), WithIdentityFile(identityFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.Start(context.Background()); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+
+		// and so does the node pinning its key
+		d, err := NewDiscoverer(0, -1, passphrase, WithBootstrapNodes(), WithMode(ModeLookupOnly),
+			WithIdentityFile(filepath.Join(dir, "node.pem")), WithKnownPeersFile(knownPeersFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.AddBackend(NewStaticBackend(peer.AuthServer.Addr().String()))
+		events := d.Events()
+		if err := d.Start(context.Background()); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		want := PeerJoined
+		if identityFile == "" {
+			want = PeerRejected
+		}
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Peer.ID != peer.ID() {
+				t.Errorf("Identity file %q: wanted %v of %s, got %+v", identityFile, want, peer.ID(), ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Identity file %q: no event", identityFile)
+		}
+		d.Stop()
+		peer.Stop()
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	for address, want := range map[string]string{
+		"1.2.3.4:80":            "1.2.3.4:80",
+		"[::ffff:1.2.3.4]:80":   "1.2.3.4:80",
+		"[2001:db8::1]:80":      "[2001:db8::1]:80",
+		"[fe80::1%eth0]:80":     "[fe80::1%eth0]:80",
+		"router.example.com:80": "router.example.com:80",
+		"[::ffff:7f00:1]:6881":  "127.0.0.1:6881",
+	} {
+		if got := normalizeAddr(address); got != want {
+			t.Errorf("normalizeAddr(%q): wanted %q, got %q", address, want, got)
+		}
+	}
+}
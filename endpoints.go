@@ -0,0 +1,173 @@
+package discover
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+///////////////////////////////////////////////////////////////////////
+// endpoints
+///////////////////////////////////////////////////////////////////////
+
+// An Endpoint is a named application port advertised by a peer, e.g. its
+// "grpc", "http" and "metrics" ports, much like a DNS SRV record. Endpoints
+// are authenticated with the same MAC as the rest of the response.
+//
+// On the wire, the endpoints section has a 2 byte length and then every
+// endpoint as a 1 byte name length, the name, 1 byte for the protocol (0 for
+// tcp, 1 for udp), the 2 byte port, a 1 byte host length and the host. All
+// the lengths and ports are little endian.
+type Endpoint struct {
+	Name     string
+	Protocol string // "tcp" or "udp"
+	Port     uint16
+	Host     string // if empty, the host of the peer
+}
+
+var endpointProtocols = []string{"tcp", "udp"}
+
+// encodes endpoints as an endpoints section
+func encodeEndpoints(endpoints []Endpoint) ([]byte, error) {
+	buf := make([]byte, 2, 2+len(endpoints)*16)
+	for _, e := range endpoints {
+		proto := -1
+		for i, p := range endpointProtocols {
+			if e.Protocol == p {
+				proto = i
+			}
+		}
+		if proto < 0 || len(e.Name) == 0 || len(e.Name) > 255 || e.Port == 0 ||
+			e.Host != "" && !validHost(e.Host) {
+			return nil, fmt.Errorf("invalid endpoint %+v", e)
+		}
+		buf = append(buf, byte(len(e.Name)))
+		buf = append(buf, e.Name...)
+		buf = append(buf, byte(proto))
+		buf = binary.LittleEndian.AppendUint16(buf, e.Port)
+		buf = append(buf, byte(len(e.Host)))
+		buf = append(buf, e.Host...)
+		if len(buf) > MAX_METADATA_LEN {
+			return nil, fmt.Errorf("endpoints longer than %d bytes", MAX_METADATA_LEN)
+		}
+	}
+	binary.LittleEndian.PutUint16(buf, uint16(len(buf)-2))
+	return buf, nil
+}
+
+// decodes an endpoints section, which must take all of buf. Endpoints with an
+// invalid host are refused, as in decodeHosts.
+func decodeEndpoints(buf []byte) ([]Endpoint, error) {
+	if len(buf) < 2 || int(binary.LittleEndian.Uint16(buf)) != len(buf)-2 {
+		return nil, ERR_IS_NOT_PEER
+	}
+	var endpoints []Endpoint
+	for buf = buf[2:]; len(buf) > 0; {
+		var e Endpoint
+		n := int(buf[0])
+		if n == 0 || len(buf) < 1+n+4 {
+			return nil, ERR_IS_NOT_PEER
+		}
+		e.Name = string(buf[1 : 1+n])
+		buf = buf[1+n:]
+		if int(buf[0]) >= len(endpointProtocols) {
+			return nil, ERR_IS_NOT_PEER
+		}
+		e.Protocol = endpointProtocols[buf[0]]
+		e.Port = binary.LittleEndian.Uint16(buf[1:])
+		n = int(buf[3])
+		if len(buf) < 4+n {
+			return nil, ERR_IS_NOT_PEER
+		}
+		e.Host = string(buf[4 : 4+n])
+		if e.Host != "" && !validHost(e.Host) {
+			return nil, ERR_IS_NOT_PEER
+		}
+		buf = buf[4+n:]
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// The hosts section has a 2 byte length and then every host as a 1 byte
+// length and the host.
+
+// encodes hosts as a hosts section
+func encodeHosts(hosts []string) ([]byte, error) {
+	buf := make([]byte, 2, 2+len(hosts)*16)
+	for _, host := range hosts {
+		if !validHost(host) {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		buf = append(buf, byte(len(host)))
+		buf = append(buf, host...)
+		if len(buf) > MAX_METADATA_LEN {
+			return nil, fmt.Errorf("hosts longer than %d bytes", MAX_METADATA_LEN)
+		}
+	}
+	binary.LittleEndian.PutUint16(buf, uint16(len(buf)-2))
+	return buf, nil
+}
+
+// decodes a hosts section, which must take all of buf. Invalid hosts are
+// refused, so they can be used without checking them again.
+func decodeHosts(buf []byte) ([]string, error) {
+	if len(buf) < 2 || int(binary.LittleEndian.Uint16(buf)) != len(buf)-2 {
+		return nil, ERR_IS_NOT_PEER
+	}
+	var hosts []string
+	for buf = buf[2:]; len(buf) > 0; {
+		n := int(buf[0])
+		if len(buf) < 1+n || !validHost(string(buf[1:1+n])) {
+			return nil, ERR_IS_NOT_PEER
+		}
+		hosts = append(hosts, string(buf[1:1+n]))
+		buf = buf[1+n:]
+	}
+	return hosts, nil
+}
+
+// returns true if host is an IP address or looks like a DNS name
+func validHost(host string) bool {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Endpoint returns the endpoint of the peer with the given name.
+func (p Peer) Endpoint(name string) (Endpoint, bool) {
+	for _, e := range p.Endpoints {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// EndpointAddr returns the host:port address of the endpoint of the peer with
+// the given name. If the endpoint has no host, the host of the peer is used.
+func (p Peer) EndpointAddr(name string) (string, bool) {
+	e, found := p.Endpoint(name)
+	if !found {
+		return "", false
+	}
+	host := e.Host
+	if host == "" {
+		var err error
+		if host, _, err = net.SplitHostPort(p.Addr); err != nil {
+			return "", false
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(e.Port))), true
+}
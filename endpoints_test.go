@@ -0,0 +1,33 @@
+package discover
+
+import "testing"
+
+func TestEndpointAddr(t *testing.T) {
+	p := Peer{Addr: "[2001:db8::1]:3000", Endpoints: []Endpoint{
+		{Name: "http", Protocol: "tcp", Port: 8080},
+		{Name: "dns", Protocol: "udp", Port: 53, Host: "ns.example.com"},
+	}}
+	for name, want := range map[string]string{"http": "[2001:db8::1]:8080", "dns": "ns.example.com:53"} {
+		if addr, ok := p.EndpointAddr(name); !ok || addr != want {
+			t.Errorf("Wanted %s endpoint at %s, got %s", name, want, addr)
+		}
+	}
+	if _, ok := p.EndpointAddr("grpc"); ok {
+		t.Errorf("Found an endpoint that was not advertised")
+	}
+
+	if _, err := encodeEndpoints([]Endpoint{{Name: "http", Protocol: "sctp", Port: 80}}); err == nil {
+		t.Errorf("Expected an error for an unknown protocol, got nil")
+	}
+
+	// hosts that are not addresses nor names are refused both ways
+	bad := []Endpoint{{Name: "http", Protocol: "tcp", Port: 80, Host: "evil.com\r\nX: 1"}}
+	if _, err := encodeEndpoints(bad); err == nil {
+		t.Errorf("Expected an error for an invalid host, got nil")
+	}
+	buf, _ := encodeEndpoints([]Endpoint{{Name: "http", Protocol: "tcp", Port: 80, Host: "example.com.1"}})
+	copy(buf[len(buf)-2:], "/p")
+	if _, err := decodeEndpoints(buf); err != ERR_IS_NOT_PEER {
+		t.Errorf("Wanted ERR_IS_NOT_PEER for an invalid host, got %v", err)
+	}
+}
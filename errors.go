@@ -22,4 +22,78 @@ var (
 
 	// the peer failed the verification test
 	ERR_DID_NOT_VERIFY = errors.New("did not pass the challenge/response")
+
+	// the challenge did not start with our magic header
+	ERR_BAD_MAGIC = errors.New("magic does not match: not a peer")
+
+	// the challenge was for a passphrase we don't know
+	ERR_UNKNOWN_KEY = errors.New("unknown key hint")
+
+	// the challenge was sent by ourselves
+	ERR_SELF_CONNECTION = errors.New("connection to self")
+
+	// the challenge did not ask for mutual authentication, and we require it
+	ERR_NOT_MUTUAL = errors.New("one-shot challenge without mutual authentication")
+
+	// the client sent a challenge, and we only accept Noise handshakes
+	ERR_NOISE_REQUIRED = errors.New("challenge/response disabled, Noise handshake required")
+
+	// the nonce in the proof was not sent by us, or it has expired
+	ERR_BAD_NONCE = errors.New("invalid or expired nonce")
+
+	// the peer presented another key than the one pinned for its address
+	ERR_KEY_MISMATCH = errors.New("peer key does not match the known one")
+
+	// the handshake did not set up a session (see Session)
+	ERR_NO_SESSION = errors.New("no session key")
+
+	// the key derivation scheme is not known
+	ERR_UNKNOWN_KDF = errors.New("unknown key derivation scheme")
+
+	// the authentication server has been closed and cannot listen again
+	ERR_SERVER_CLOSED = errors.New("authentication server closed")
+
+	// the discoverer has already been started
+	ERR_ALREADY_STARTED = errors.New("discoverer already started")
+
+	// the discoverer has been stopped and cannot be started again
+	ERR_STOPPED = errors.New("discoverer stopped")
 )
+
+// short names of the errors above, for logs
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{ERR_INVALID_ADDR, "invalid_addr"},
+	{ERR_COULD_NOT_CONNECT, "could_not_connect"},
+	{ERR_COULD_NOT_SEND, "could_not_send"},
+	{ERR_DID_NOT_RESPOND, "did_not_respond"},
+	{ERR_IS_NOT_PEER, "is_not_peer"},
+	{ERR_DID_NOT_VERIFY, "did_not_verify"},
+	{ERR_BAD_MAGIC, "bad_magic"},
+	{ERR_UNKNOWN_KEY, "unknown_key"},
+	{ERR_SELF_CONNECTION, "self_connection"},
+	{ERR_NOT_MUTUAL, "not_mutual"},
+	{ERR_NOISE_REQUIRED, "noise_required"},
+	{ERR_BAD_NONCE, "bad_nonce"},
+	{ERR_KEY_MISMATCH, "key_mismatch"},
+	{ERR_NO_SESSION, "no_session"},
+	{ERR_UNKNOWN_KDF, "unknown_kdf"},
+	{ERR_SERVER_CLOSED, "server_closed"},
+	{ERR_ALREADY_STARTED, "already_started"},
+	{ERR_STOPPED, "stopped"},
+}
+
+// returns the short name of err, "other" if it is not one of ours
+func errorKind(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "other"
+}
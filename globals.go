@@ -1,18 +1,79 @@
 package discover
 
+import "time"
+
 const (
-	LEN_UDP_POOLS   = 100
-	LEN_UDP_BUF     = 4096
-	LEN_MSG         = 20
-	LEN_DEDUPE      = 10
-	DEFAULT_TIMEOUT = 300 // default timeout in milliseconds
+	LEN_UDP_POOLS    = 100
+	LEN_UDP_BUF      = 4096
+	LEN_MSG          = 20
+	LEN_DEDUPE       = 10
+	LEN_KEY_HINT     = 4
+	LEN_CHALLENGE_V1 = 36   // challenges from nodes without key hints
+	LEN_CHALLENGE_V2 = 40   // challenges from nodes without key derivation schemes
+	LEN_CHALLENGE_V3 = 41   // challenges from nodes without flags
+	LEN_CHALLENGE    = 42   // challenges with flags
+	MAX_METADATA_LEN = 1024 // longest metadata or endpoints section
+	FLAG_METADATA    = 1    // the client wants the metadata of the peer
+	FLAG_ENDPOINTS   = 2    // the client wants the endpoints of the peer
+	FLAG_HOSTS       = 4    // the client wants the hosts of the peer
+	FLAG_MUTUAL      = 8    // the client proves it knows the passphrase too
+	FLAG_IDENTITY    = 16   // the client wants the signed identity of the peer
+	LEN_NONCE        = 20
+	LEN_NONCE_MSG    = 56  // magic header, dedupe, challenge and nonce
+	LEN_PROOF        = 94  // challenge, nonce and MAC
+	DEFAULT_TIMEOUT  = 300 // default timeout in milliseconds
+	LEN_UDP_MIN_BUF  = 512 // smallest UDP buffer that fits our messages
+
+	PROTOCOL_VERSION       = 1                // version of the mutual handshake, bound to its MACs
+	DEFAULT_VERIFY_RETRIES = 2                // times a challenge is sent before giving up
+	NONCE_LIFETIME         = 10 * time.Second // nonces expire after one or two of these
+	SILENT_CANDIDATE_TIME  = 10 * time.Minute // candidates that answered nothing are not tried again for this long
+
+	DEFAULT_MIN_PEERS           = 1
+	DEFAULT_FAST_QUERY_INTERVAL = 500 * time.Millisecond // time between DHT queries while looking for minPeers
+	DEFAULT_QUERY_INTERVAL      = 1 * time.Minute        // steady-state time between DHT queries
+	MAX_PARALLEL_VERIFY         = 8                      // peers being verified at the same time
+
+	DEFAULT_REVERIFY_INTERVAL = 1 * time.Minute // time between verifications of known peers
+	DEFAULT_MAX_FAILURES      = 3               // failed verifications before expiring a peer
+	LEN_EVENTS                = 16              // size of the peer events queue
+	LEN_CANDIDATES            = 64              // size of the candidates queue
+	LEN_DISCOVERED_PEERS      = 64              // size of the DiscoveredPeers queues
+
+	DEFAULT_PING_TIMEOUT       = 2 * time.Second // time we wait for DHT nodes to answer a ping
+	DEFAULT_BOOTSTRAP_INTERVAL = 5 * time.Minute // bootstrap again after this long without DHT results
+	BOOTSTRAP_NODES_WANTED     = 2               // bootstrap nodes added to the DHT
+	MAX_CACHED_NODES           = 32              // DHT nodes remembered as fallbacks or saved
+
+	DEFAULT_PROBE_INTERVAL = 30 * time.Second // time between health probes of the known peers
+	DEFAULT_PROBE_TIMEOUT  = 2 * time.Second  // time a health probe can take
+
+	DEFAULT_SAVE_INTERVAL = 5 * time.Minute    // time between saves of the state file
+	MAX_STATE_PEER_AGE    = 7 * 24 * time.Hour // cached peers older than this are forgotten
+
+	DEFAULT_KDF = KDF_HKDF // key derivation scheme, see keys.go
+	SCRYPT_N    = 1 << 15  // scrypt cost parameters, for KDF_SCRYPT
+	SCRYPT_R    = 8
+	SCRYPT_P    = 1
+	// Every peer of a service must stretch the passphrase in the same way,
+	// so the scrypt salt is fixed.
+	SCRYPT_SALT = "discover scrypt salt"
 )
 
+// Upper bounds of the buckets of the verification latency histogram.
+var LATENCY_BUCKETS = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, 1 * time.Second,
+}
+
 // Identifies messages.
 var magicHeader = []byte("XXUU7611")
 
 // dedupe is needed to ignore connections from self.
 var dedupe []byte
 
+// Key of the nonces sent by our AuthServers.
+var nonceKey []byte
+
 // If true, connections to self are allowed - used for testing.
 var allowSelfConnection = false
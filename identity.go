@@ -0,0 +1,174 @@
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////
+// node identities
+///////////////////////////////////////////////////////////////////////
+
+// Every node has an Ed25519 key, which identifies it whatever its address.
+// With FLAG_IDENTITY, the server sends an identity section as the last one
+// of the response: a 2 byte length, its 32 bytes public key and a 64 bytes
+// signature of the response (see identitySigned). Unlike the MAC, which any
+// node with the passphrase can compute, the signature can only come from the
+// node holding the key.
+
+// returns the key stored in path, or creates it if there is no file
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// returns the ID of the node with a public key: the hex of half its SHA256
+func nodeID(key ed25519.PublicKey) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+// returns what the identity section of a response signs: what binds it to the
+// handshake (the challenge, the transcript or the Noise handshake hash), the
+// port and the sections before it
+func identitySigned(binding []byte, port uint16, sections []byte) []byte {
+	buf := append([]byte("discover identity"), binding...)
+	buf = binary.LittleEndian.AppendUint16(buf, port)
+	return append(buf, sections...)
+}
+
+// encodes the identity section of a response, an empty one without key
+func encodeIdentity(key ed25519.PrivateKey, signed []byte) []byte {
+	if key == nil {
+		return emptySection
+	}
+	buf := binary.LittleEndian.AppendUint16(nil, ed25519.PublicKeySize+ed25519.SignatureSize)
+	buf = append(buf, key.Public().(ed25519.PublicKey)...)
+	return append(buf, ed25519.Sign(key, signed)...)
+}
+
+// decodes an identity section, which must take all of buf, and returns the
+// public key if the signature is valid. The key is nil for an empty section.
+func decodeIdentity(buf []byte, signed []byte) (ed25519.PublicKey, error) {
+	buf = buf[2:]
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if len(buf) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, ERR_IS_NOT_PEER
+	}
+	key := ed25519.PublicKey(bytes.Clone(buf[:ed25519.PublicKeySize]))
+	if !ed25519.Verify(key, signed, buf[ed25519.PublicKeySize:]) {
+		return nil, ERR_DID_NOT_VERIFY
+	}
+	return key, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// known peers
+///////////////////////////////////////////////////////////////////////
+
+// The keys of the peers, pinned by the address where they answer challenges
+// the first time they are seen, as SSH does with known_hosts. A peer
+// presenting another key, or none, at a pinned address is an impostor, even
+// if it knows the passphrase. A known key seen at a new address is pinned
+// there too, as its node has moved.
+//
+// The file has a line per address, with the address and the hex of the key.
+type knownPeers struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]string // hex of the keys, by address
+}
+
+// loads the known peers from path. A missing file has no peers.
+func loadKnownPeers(path string) (*knownPeers, error) {
+	k := &knownPeers{path: path, keys: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %q", path, scanner.Text())
+		}
+		k.keys[fields[0]] = fields[1]
+	}
+	return k, scanner.Err()
+}
+
+// checks the key presented by the peer at addr, pinning it if it is the
+// first one. It returns ERR_KEY_MISMATCH for impostors.
+func (k *knownPeers) check(addr string, key ed25519.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pinned, found := k.keys[addr]
+	if found && pinned != hex.EncodeToString(key) {
+		return ERR_KEY_MISMATCH
+	}
+	if found || key == nil {
+		return nil
+	}
+	k.keys[addr] = hex.EncodeToString(key)
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", addr, k.keys[addr]); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
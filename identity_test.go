@@ -0,0 +1,77 @@
+package discover
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	key, err := loadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := loadIdentity(path); err != nil || !key.Equal(loaded) {
+		t.Fatalf("Key not reloaded: %v", err)
+	}
+
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, []byte("secret"))
+	server.Identity = key
+	startServer(t, server)
+
+	client, _ := NewAuthClient(0, []byte("secret"))
+	response, err := client.Verify(server.Addr().String())
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	public := key.Public().(ed25519.PublicKey)
+	if !public.Equal(response.PublicKey) {
+		t.Errorf("Wanted key %x, got %x", public, response.PublicKey)
+	}
+
+	// a signature for another port does not verify
+	challenge, _ := NewChallenge()
+	signed := identitySigned(challenge.Challenge[:], 3000, nil)
+	section := encodeIdentity(key, signed)
+	if _, err := decodeIdentity(section, identitySigned(challenge.Challenge[:], 3001, nil)); err != ERR_DID_NOT_VERIFY {
+		t.Errorf("Wanted ERR_DID_NOT_VERIFY, got %v", err)
+	}
+	if _, err := decodeIdentity(section, signed); err != nil {
+		t.Errorf("Identity not verified: %v", err)
+	}
+}
+
+func TestKnownPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	known, err := loadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _, _ := ed25519.GenerateKey(nil)
+	b, _, _ := ed25519.GenerateKey(nil)
+
+	if err := known.check("10.0.0.1:4000", a); err != nil {
+		t.Fatalf("First key not pinned: %v", err)
+	}
+	if err := known.check("10.0.0.2:4000", b); err != nil {
+		t.Fatalf("First key not pinned: %v", err)
+	}
+
+	// the pins are kept across restarts
+	if known, err = loadKnownPeers(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := known.check("10.0.0.1:4000", a); err != nil {
+		t.Errorf("Pinned key rejected: %v", err)
+	}
+	for _, key := range []ed25519.PublicKey{b, nil} {
+		if err := known.check("10.0.0.1:4000", key); err != ERR_KEY_MISMATCH {
+			t.Errorf("Wanted ERR_KEY_MISMATCH, got %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); len(data) == 0 {
+		t.Errorf("Empty known peers file")
+	}
+}
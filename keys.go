@@ -0,0 +1,126 @@
+package discover
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+///////////////////////////////////////////////////////////////////////
+// key derivation
+///////////////////////////////////////////////////////////////////////
+
+// Key derivation schemes. The scheme is sent with the challenges, so that
+// nodes using different schemes can be told apart.
+const (
+	// The passphrase is the MAC key, and the infohash is the SHA1 of half
+	// its SHA256. Cheap to attack offline, only for talking to older nodes.
+	KDF_LEGACY = 0
+	// Keys derived from the passphrase with HKDF-SHA256.
+	KDF_HKDF = 1
+	// Keys derived with HKDF-SHA256 from the passphrase stretched with
+	// scrypt, for low-entropy passphrases. Deriving them takes a while, but
+	// it is only done once per passphrase.
+	KDF_SCRYPT = 2
+)
+
+// The keys derived from a passphrase with one of the schemes.
+type keySet struct {
+	version byte
+	seed    []byte // the infohashes are derived from it
+	mac     []byte // key of the challenge MACs
+	enc     []byte // key for encrypting what is sent to the peers
+	hint    [LEN_KEY_HINT]byte
+}
+
+// derived keys, by a hash of the scheme and the passphrase. Only the map keys
+// are hashed: the passphrases are still kept by the services and servers, and
+// the keys of KDF_LEGACY are the passphrase itself. Stretching passphrases is
+// slow, and every verification needs the keys.
+var keyCache = struct {
+	sync.Mutex
+	keys map[[sha256.Size]byte]*cachedKeys
+}{keys: make(map[[sha256.Size]byte]*cachedKeys)}
+
+// keys in the cache, which may still be being derived
+type cachedKeys struct {
+	done chan struct{} // closed once keys and err are set
+	keys *keySet
+	err  error
+}
+
+// returns the keys derived from passphrase with a scheme. They are derived
+// once, without holding the cache, so a slow derivation only holds up those
+// needing the same keys.
+func deriveKeys(passphrase []byte, version byte) (*keySet, error) {
+	cacheKey := sha256.Sum256(append([]byte{version}, passphrase...))
+	keyCache.Lock()
+	cached, found := keyCache.keys[cacheKey]
+	if !found {
+		cached = &cachedKeys{done: make(chan struct{})}
+		keyCache.keys[cacheKey] = cached
+	}
+	keyCache.Unlock()
+	if found {
+		<-cached.done
+		return cached.keys, cached.err
+	}
+
+	cached.keys, cached.err = newKeySet(passphrase, version)
+	if cached.err != nil {
+		keyCache.Lock()
+		delete(keyCache.keys, cacheKey)
+		keyCache.Unlock()
+	}
+	close(cached.done)
+	return cached.keys, cached.err
+}
+
+// derives the keys of a passphrase with a scheme
+func newKeySet(passphrase []byte, version byte) (*keySet, error) {
+	keys := &keySet{version: version}
+	switch version {
+	case KDF_LEGACY:
+		keys.seed = infoHashSeed(passphrase)
+		keys.mac = passphrase
+		keys.enc = hkdfKey(passphrase, "encryption")
+		keys.hint = keyHint(passphrase)
+	case KDF_HKDF, KDF_SCRYPT:
+		secret := passphrase
+		if version == KDF_SCRYPT {
+			stretched, err := scrypt.Key(passphrase, []byte(SCRYPT_SALT), SCRYPT_N, SCRYPT_R, SCRYPT_P, sha256.Size)
+			if err != nil {
+				return nil, fmt.Errorf("could not stretch the passphrase: %v", err)
+			}
+			secret = stretched
+		}
+		keys.seed = hkdfKey(secret, "infohash")
+		keys.mac = hkdfKey(secret, "mac")
+		keys.enc = hkdfKey(secret, "encryption")
+		copy(keys.hint[:], hkdfKey(secret, "key hint"))
+	default:
+		return nil, ERR_UNKNOWN_KDF
+	}
+	return keys, nil
+}
+
+// derives a 32 byte key for a purpose from secret
+func hkdfKey(secret []byte, purpose string) []byte {
+	key := make([]byte, sha256.Size)
+	// reading less than 255 hashes from HKDF cannot fail
+	io.ReadFull(hkdf.New(sha256.New, secret, []byte("discover"), []byte(purpose)), key)
+	return key
+}
+
+// returns the schemes we use for a passphrase: kdf, and the legacy one if
+// we still talk to older nodes
+func kdfVersions(kdf byte, legacy bool) []byte {
+	if legacy && kdf != KDF_LEGACY {
+		return []byte{kdf, KDF_LEGACY}
+	}
+	return []byte{kdf}
+}
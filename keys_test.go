@@ -0,0 +1,78 @@
+package discover
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/nictuku/dht"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	passphrase := []byte("secret")
+	legacy, _ := deriveKeys(passphrase, KDF_LEGACY)
+	h := sha256.Sum256(passphrase)
+	h160 := sha1.Sum(h[:sha256.Size/2])
+	if !bytes.Equal(legacy.mac, passphrase) || infoHash(legacy.seed) != dht.InfoHash(h160[:]) {
+		t.Errorf("KDF_LEGACY keys are not those of older nodes")
+	}
+	if legacy.hint != keyHint(passphrase) {
+		t.Errorf("KDF_LEGACY key hint is not that of older nodes")
+	}
+
+	hkdf, _ := deriveKeys(passphrase, KDF_HKDF)
+	stretched, err := deriveKeys(passphrase, KDF_SCRYPT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range []*keySet{hkdf, stretched} {
+		if bytes.Equal(keys.mac, keys.seed) || bytes.Equal(keys.mac, keys.enc) || bytes.Equal(keys.mac, passphrase) {
+			t.Errorf("Keys of scheme %d are not independent", keys.version)
+		}
+	}
+	if bytes.Equal(hkdf.mac, stretched.mac) || hkdf.hint == stretched.hint {
+		t.Errorf("KDF_HKDF and KDF_SCRYPT give the same keys")
+	}
+	if again, _ := deriveKeys([]byte("secret"), KDF_SCRYPT); again != stretched {
+		t.Errorf("Derived keys are not cached")
+	}
+	if _, err := deriveKeys(passphrase, 42); err != ERR_UNKNOWN_KDF {
+		t.Errorf("Expected ERR_UNKNOWN_KDF, got %v", err)
+	}
+}
+
+func TestDeriveKeysConcurrently(t *testing.T) {
+	// a derivation in progress
+	slow := []byte("slow secret")
+	cacheKey := sha256.Sum256(append([]byte{KDF_SCRYPT}, slow...))
+	pending := &cachedKeys{done: make(chan struct{})}
+	keyCache.Lock()
+	keyCache.keys[cacheKey] = pending
+	keyCache.Unlock()
+	t.Cleanup(func() {
+		keyCache.Lock()
+		delete(keyCache.keys, cacheKey)
+		keyCache.Unlock()
+	})
+
+	// holds up those needing the same keys, and nobody else
+	results := make(chan *keySet)
+	go func() {
+		keys, _ := deriveKeys(slow, KDF_SCRYPT)
+		results <- keys
+	}()
+	if _, err := deriveKeys([]byte("fast secret"), KDF_SCRYPT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-results:
+		t.Fatalf("Keys returned before being derived")
+	default:
+	}
+	pending.keys = &keySet{version: KDF_SCRYPT}
+	close(pending.done)
+	if keys := <-results; keys != pending.keys {
+		t.Errorf("Keys derived again")
+	}
+}
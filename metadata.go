@@ -0,0 +1,80 @@
+package discover
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+///////////////////////////////////////////////////////////////////////
+// metadata
+///////////////////////////////////////////////////////////////////////
+
+// Metadata are the key/value pairs a peer advertises along with its
+// application port, e.g. "version" or "zone". They are authenticated with the
+// same MAC as the rest of the response.
+//
+// On the wire, the metadata section has a 2 byte length and then every pair
+// sorted by key, as a 1 byte key length, the key, a 2 byte value length and
+// the value. All the lengths are little endian.
+
+// encodes metadata as a metadata section
+func encodeMetadata(metadata map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 2, 2+len(metadata)*8)
+	for _, k := range keys {
+		v := metadata[k]
+		if len(k) == 0 || len(k) > 255 {
+			return nil, fmt.Errorf("invalid metadata key %q", k)
+		}
+		buf = append(buf, byte(len(k)))
+		buf = append(buf, k...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v)))
+		buf = append(buf, v...)
+		if len(buf) > MAX_METADATA_LEN {
+			return nil, fmt.Errorf("metadata longer than %d bytes", MAX_METADATA_LEN)
+		}
+	}
+	binary.LittleEndian.PutUint16(buf, uint16(len(buf)-2))
+	return buf, nil
+}
+
+// splits the section at the start of buf from the rest
+func splitSection(buf []byte) (section, rest []byte, err error) {
+	if len(buf) < 2 {
+		return nil, nil, ERR_IS_NOT_PEER
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(buf))
+	if len(buf) < n {
+		return nil, nil, ERR_IS_NOT_PEER
+	}
+	return buf[:n], buf[n:], nil
+}
+
+// decodes a metadata section, which must take all of buf
+func decodeMetadata(buf []byte) (map[string]string, error) {
+	if len(buf) < 2 || int(binary.LittleEndian.Uint16(buf)) != len(buf)-2 {
+		return nil, ERR_IS_NOT_PEER
+	}
+	metadata := make(map[string]string)
+	for buf = buf[2:]; len(buf) > 0; {
+		n := int(buf[0])
+		if n == 0 || len(buf) < 1+n+2 {
+			return nil, ERR_IS_NOT_PEER
+		}
+		k := string(buf[1 : 1+n])
+		buf = buf[1+n:]
+		n = int(binary.LittleEndian.Uint16(buf))
+		if len(buf) < 2+n {
+			return nil, ERR_IS_NOT_PEER
+		}
+		metadata[k] = string(buf[2 : 2+n])
+		buf = buf[2+n:]
+	}
+	return metadata, nil
+}
@@ -0,0 +1,234 @@
+package discover
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Noise handshake
+///////////////////////////////////////////////////////////////////////
+
+// Instead of the challenge and the response, the peers can authenticate each
+// other with a Noise_NNpsk0_25519_ChaChaPoly_SHA256 handshake, keyed with the
+// encryption key derived from the passphrase (see Config.Noise). Only peers
+// knowing the passphrase can read or write its messages, and the port and the
+// sections the server sends are encrypted with forward secrecy.
+//
+// The messages are v2 frames (see wire.go). MSG_NOISE_INIT has the key hint
+// and the scheme in the clear, so the server can select the key, and the
+// first handshake message, whose payload is the dedupe ID of the client and
+// the flags of the sections it wants. MSG_NOISE_RESPONSE has the second
+// handshake message, whose payload is the port and the sections, as in a
+// response; the identity is bound to the handshake hash after the first
+// message. The key hint and the scheme are part of the prologue, and the
+// server sends them back so LANBackend can tell the services apart.
+//
+// As with the nonce of the mutual handshake, the server does not answer the
+// first MSG_NOISE_INIT from an address: it sends back a MSG_NOISE_COOKIE with
+// its dedupe ID and a stateless cookie for the address and the handshake
+// message, which the client sends again with the cookie. So the server only
+// does the DH and sends its larger response to addresses that answered it,
+// and only for a NONCE_LIFETIME or two, and the client can tell when it is
+// talking to itself. The cookie is smaller than the message it answers.
+
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// starts a Noise handshake keyed with keys, whose hint and scheme are in the
+// prologue
+func newNoiseHandshake(keys *keySet, initiator bool) (*noise.HandshakeState, error) {
+	prologue := append([]byte("discover noise"), keys.hint[:]...)
+	return noise.NewHandshakeState(noise.Config{
+		CipherSuite:           noiseSuite,
+		Pattern:               noise.HandshakeNN,
+		Initiator:             initiator,
+		Prologue:              append(prologue, keys.version),
+		PresharedKey:          keys.enc,
+		PresharedKeyPlacement: 0,
+	})
+}
+
+// returns true if buf is a MSG_NOISE_INIT frame
+func isNoiseFrame(buf []byte) bool {
+	return isFrame(buf) && buf[len(frameHeader)] == MSG_NOISE_INIT
+}
+
+// returns the first message of a Noise handshake with keys, asking for the
+// sections in flags
+func newNoiseInit(keys *keySet, flags byte) (*noise.HandshakeState, []byte, error) {
+	hs, err := newNoiseHandshake(keys, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, _, _, err := hs.WriteMessage(nil, append(bytes.Clone(dedupe), flags))
+	if err != nil {
+		return nil, nil, err
+	}
+	return hs, noiseInitFrame(keys.hint, keys.version, msg, nil), nil
+}
+
+// returns a MSG_NOISE_INIT frame, with the cookie if there is one. The cookie
+// goes before the handshake message, the last field on TCP (see
+// requestFields).
+func noiseInitFrame(hint [LEN_KEY_HINT]byte, kdf byte, msg []byte, cookie []byte) []byte {
+	fields := []tlv{{TLV_KEY_HINT, hint[:]}, {TLV_KDF, []byte{kdf}}}
+	if cookie != nil {
+		fields = append(fields, tlv{TLV_COOKIE, cookie})
+	}
+	return encodeFrame(MSG_NOISE_INIT, append(fields, tlv{TLV_NOISE, msg})...)
+}
+
+// returns the key hint and the scheme of a Noise frame, and its fields
+func parseNoiseFrame(buf []byte, msgType byte) (hint [LEN_KEY_HINT]byte, kdf byte, fields map[byte][]byte, err error) {
+	t, fields, err := decodeFrame(buf)
+	if err != nil || t != msgType {
+		return hint, 0, nil, ERR_IS_NOT_PEER
+	}
+	kdfField := []byte{0}
+	if fixedField(fields, TLV_KEY_HINT, hint[:]) != nil || fixedField(fields, TLV_KDF, kdfField) != nil {
+		return hint, 0, nil, ERR_IS_NOT_PEER
+	}
+	return hint, kdfField[0], fields, nil
+}
+
+// returns the cookie for the Noise handshake message msg from addr, at the
+// given time
+func makeCookie(addr string, hint [LEN_KEY_HINT]byte, kdf byte, msg []byte, at time.Time) []byte {
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte("discover noise cookie"))
+	binary.Write(mac, binary.LittleEndian, at.UnixNano()/int64(NONCE_LIFETIME))
+	mac.Write([]byte(addr))
+	mac.Write(hint[:])
+	mac.Write([]byte{kdf})
+	mac.Write(msg)
+	return mac.Sum(nil)[:LEN_NONCE]
+}
+
+// answers the first message of a Noise handshake, if the client knows the
+// passphrase of the key hint. Without a cookie, or with an expired one, the
+// answer is a new cookie, and final is false.
+func (a *AuthServer) respondNoise(addr string, buf []byte) (reply []byte, final bool, err error) {
+	hint, kdf, fields, err := parseNoiseFrame(buf, MSG_NOISE_INIT)
+	if err != nil {
+		return nil, false, err
+	}
+	msg, found := fields[TLV_NOISE]
+	if !found {
+		return nil, false, ERR_IS_NOT_PEER
+	}
+	if hint == [LEN_KEY_HINT]byte{} {
+		return nil, false, ERR_UNKNOWN_KEY
+	}
+	key, err := a.lookupKey(hint, kdf)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	cookie := fields[TLV_COOKIE]
+	if !hmac.Equal(cookie, makeCookie(addr, hint, kdf, msg, now)) &&
+		!hmac.Equal(cookie, makeCookie(addr, hint, kdf, msg, now.Add(-NONCE_LIFETIME))) {
+		return encodeFrame(MSG_NOISE_COOKIE,
+			tlv{TLV_DEDUPE, dedupe},
+			tlv{TLV_KEY_HINT, hint[:]},
+			tlv{TLV_KDF, []byte{kdf}},
+			tlv{TLV_COOKIE, makeCookie(addr, hint, kdf, msg, now)}), false, nil
+	}
+
+	hs, err := newNoiseHandshake(key.keys, false)
+	if err != nil {
+		return nil, false, err
+	}
+	payload, _, _, err := hs.ReadMessage(nil, msg)
+	if err != nil || len(payload) != LEN_DEDUPE+1 {
+		return nil, false, ERR_DID_NOT_VERIFY
+	}
+	if !allowSelfConnection && bytes.Equal(payload[:LEN_DEDUPE], dedupe) {
+		return nil, false, ERR_SELF_CONNECTION
+	}
+
+	port := uint16(key.appPort)
+	sections := appendSections(key, a.Identity, payload[LEN_DEDUPE], port, hs.ChannelBinding())
+	reply, cs1, cs2, err := hs.WriteMessage(nil, append(binary.LittleEndian.AppendUint16(nil, port), sections...))
+	if err != nil {
+		return nil, false, err
+	}
+	if a.OnSession != nil {
+		a.OnSession(addr, newNoiseSession(hs, cs1, cs2))
+	}
+	return encodeFrame(MSG_NOISE_RESPONSE,
+		tlv{TLV_KEY_HINT, hint[:]},
+		tlv{TLV_KDF, []byte{kdf}},
+		tlv{TLV_NOISE, reply}), true, nil
+}
+
+// returns the session of a completed Noise handshake, derived from the keys
+// of both directions and the final handshake hash
+func newNoiseSession(hs *noise.HandshakeState, cs1, cs2 *noise.CipherState) *Session {
+	k1, k2 := cs1.UnsafeKey(), cs2.UnsafeKey()
+	return newSession(append(k1[:], k2[:]...), hs.ChannelBinding())
+}
+
+// verifyNoise verifies the peer at address with a Noise handshake with keys,
+// over UDP.
+func (a *AuthClient) verifyNoise(address string, keys *keySet) (*Response, error) {
+	a.logger.Debug("verifying peer", "peer", address, "noise", true)
+	flags := byte(FLAG_METADATA | FLAG_ENDPOINTS | FLAG_HOSTS | FLAG_IDENTITY)
+	hs, init, err := newNoiseInit(keys, flags)
+	if err != nil {
+		return nil, err
+	}
+	// reading the answer changes the handshake hash in place
+	binding := bytes.Clone(hs.ChannelBinding())
+
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, ERR_INVALID_ADDR
+	}
+	udpConn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, ERR_COULD_NOT_CONNECT
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(time.Duration(a.Timeout) * time.Millisecond))
+
+	// the server answers with a cookie first
+	buf, err := exchange(udpConn, init)
+	if err != nil {
+		return nil, err
+	}
+	hint, kdf, fields, err := parseNoiseFrame(buf, MSG_NOISE_COOKIE)
+	cookie := fields[TLV_COOKIE]
+	if err != nil || hint != keys.hint || kdf != keys.version || len(cookie) != LEN_NONCE ||
+		len(fields[TLV_DEDUPE]) != LEN_DEDUPE {
+		return nil, ERR_DID_NOT_VERIFY
+	}
+	if !allowSelfConnection && bytes.Equal(fields[TLV_DEDUPE], dedupe) {
+		return nil, ERR_SELF_CONNECTION
+	}
+	_, _, fields, _ = parseNoiseFrame(init, MSG_NOISE_INIT)
+	if buf, err = exchange(udpConn, noiseInitFrame(keys.hint, keys.version, fields[TLV_NOISE], cookie)); err != nil {
+		return nil, err
+	}
+	_, _, fields, err = parseNoiseFrame(buf, MSG_NOISE_RESPONSE)
+	msg, found := fields[TLV_NOISE]
+	if err != nil || !found {
+		return nil, ERR_DID_NOT_VERIFY
+	}
+	payload, cs1, cs2, err := hs.ReadMessage(nil, msg)
+	if err != nil || len(payload) < 2 {
+		return nil, ERR_DID_NOT_VERIFY
+	}
+	response := &Response{Port: binary.LittleEndian.Uint16(payload)}
+	if !response.decodeSections(flags, payload[2:], binding) {
+		return nil, ERR_DID_NOT_VERIFY
+	}
+	response.Session = newNoiseSession(hs, cs1, cs2)
+	a.logger.Debug("peer verified", "peer", address)
+	return response, nil
+}
@@ -0,0 +1,81 @@
+package discover
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+)
+
+func TestNoise(t *testing.T) {
+	config := DefaultConfig()
+	config.Noise = true
+	config.VerifyRetries = 1
+	_, config.Identity, _ = ed25519.GenerateKey(nil)
+	passphrase := []byte("secret")
+	metadata := map[string]string{"zone": "eu-1"}
+
+	server := newAuthServer("127.0.0.1:0", 3000, passphrase, &config)
+	server.SetMetadata(metadata)
+	startServer(t, server)
+
+	client := newAuthClient(0, passphrase, &config)
+	response, err := client.Verify(server.Addr().String())
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if response.Port != 3000 || !reflect.DeepEqual(response.Metadata, metadata) ||
+		!config.Identity.Public().(ed25519.PublicKey).Equal(response.PublicKey) {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	// handshakes are first answered with a cookie, no larger than them
+	keys, _ := deriveKeys(passphrase, DEFAULT_KDF)
+	_, init, _ := newNoiseInit(keys, FLAG_METADATA)
+	withCookie := func(keys *keySet, init []byte) []byte {
+		reply, final, err := server.handleMessage("192.0.2.1:1000", init)
+		_, _, fields, cookieErr := parseNoiseFrame(reply, MSG_NOISE_COOKIE)
+		if err != nil || final || cookieErr != nil || len(reply) > len(init) {
+			t.Fatalf("Wanted a cookie, got %v", err)
+		}
+		_, _, initFields, _ := parseNoiseFrame(init, MSG_NOISE_INIT)
+		return noiseInitFrame(keys.hint, keys.version, initFields[TLV_NOISE], fields[TLV_COOKIE])
+	}
+	init = withCookie(keys, init)
+
+	// which is only good for the address it was sent to
+	if _, final, _ := server.handleMessage("192.0.2.2:1000", init); final {
+		t.Errorf("Cookie accepted from another address")
+	}
+
+	// what is advertised is encrypted
+	reply, final, err := server.handleMessage("192.0.2.1:1000", init)
+	if err != nil || !final {
+		t.Fatalf("Wanted a response, got %v", err)
+	}
+	if bytes.Contains(reply, []byte("eu-1")) {
+		t.Errorf("Metadata sent in the clear")
+	}
+
+	// challenges are not answered, nor are handshakes with another passphrase
+	challenge, _ := NewChallenge()
+	challenge.KeyHint = keys.hint
+	challenge.KDF = keys.version
+	challenge.Flags = FLAG_MUTUAL
+	if _, _, err := server.handleMessage("192.0.2.1:1000", challenge.frame()); err != ERR_NOISE_REQUIRED {
+		t.Errorf("Wanted ERR_NOISE_REQUIRED, got %v", err)
+	}
+	other, _ := deriveKeys([]byte("other"), DEFAULT_KDF)
+	forged := *other
+	forged.hint = keys.hint
+	_, init, _ = newNoiseInit(&forged, FLAG_METADATA)
+	if _, _, err := server.handleMessage("192.0.2.1:1000", withCookie(&forged, init)); err != ERR_DID_NOT_VERIFY {
+		t.Errorf("Wanted ERR_DID_NOT_VERIFY, got %v", err)
+	}
+
+	// the client finds out when it is talking to itself
+	allowSelfConnection = false
+	if _, err := client.Verify(server.Addr().String()); err != ERR_SELF_CONNECTION {
+		t.Errorf("Wanted ERR_SELF_CONNECTION, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package discover
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// peer table
+///////////////////////////////////////////////////////////////////////
+
+// Kind of change in the peer table.
+type PeerEventType int
+
+const (
+	PeerJoined   PeerEventType = iota // a new peer has been verified
+	PeerLeft                          // a peer stopped answering and was expired
+	PeerUpdated                       // a known peer changed its advertised port
+	PeerRejected                      // a peer presented another key than the known one
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "joined"
+	case PeerLeft:
+		return "left"
+	case PeerUpdated:
+		return "updated"
+	case PeerRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// A change in the set of known peers.
+type PeerEvent struct {
+	Type PeerEventType
+	Peer Peer
+}
+
+// The table of verified peers, indexed by the address where they answer
+// challenges.
+type peerTable struct {
+	mu       sync.Mutex
+	peers    map[string]*Peer
+	reported map[string]bool // peers sent to DiscoveredPeers
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{
+		peers:    make(map[string]*Peer),
+		reported: make(map[string]bool),
+	}
+}
+
+// verified records a successful verification of the peer at authAddr that
+// advertised peer. A peer with the ID of one known at another address has
+// moved, and replaces it. The health of a known peer is kept, as only probed
+// updates it. It returns the updated peer and the event to report, if any.
+func (t *peerTable) verified(authAddr string, peer Peer, now time.Time) (Peer, *PeerEventType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.peers[authAddr]
+	if !found {
+		if moved := t.byID(peer.ID); moved != nil {
+			// the same node at another address: it has moved
+			delete(t.peers, moved.AuthAddr)
+			if t.reported[moved.AuthAddr] {
+				delete(t.reported, moved.AuthAddr)
+				t.reported[authAddr] = true
+			}
+			peer.AuthAddr = authAddr
+			peer.FirstSeen = moved.FirstSeen
+			peer.LastVerified = now
+			t.peers[authAddr] = &peer
+			ev := PeerUpdated
+			return peer, &ev
+		}
+		peer.AuthAddr = authAddr
+		peer.FirstSeen = now
+		peer.LastVerified = now
+		t.peers[authAddr] = &peer
+		ev := PeerJoined
+		return peer, &ev
+	}
+
+	changed := p.Addr != peer.Addr || p.Port != peer.Port || p.ID != peer.ID ||
+		!maps.Equal(p.Metadata, peer.Metadata) || !slices.Equal(p.Endpoints, peer.Endpoints) ||
+		!slices.Equal(p.Hosts, peer.Hosts)
+	p.Addr = peer.Addr
+	p.Port = peer.Port
+	p.ID = peer.ID
+	p.PublicKey = peer.PublicKey
+	p.Metadata = peer.Metadata
+	p.Endpoints = peer.Endpoints
+	p.Hosts = peer.Hosts
+	p.Session = peer.Session
+	p.LastVerified = now
+	p.Failures = 0
+	if changed {
+		ev := PeerUpdated
+		return *p, &ev
+	}
+	return *p, nil
+}
+
+// failed records a failed verification of the peer at authAddr. Once it has
+// failed maxFailures times in a row it is removed and returned with removed
+// set to true.
+func (t *peerTable) failed(authAddr string, maxFailures int) (peer Peer, removed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.peers[authAddr]
+	if !found {
+		return Peer{}, false
+	}
+	p.Failures++
+	if p.Failures >= maxFailures {
+		delete(t.peers, authAddr)
+		delete(t.reported, authAddr)
+		return *p, true
+	}
+	return *p, false
+}
+
+// returns the peer with a node ID, nil if there is none. Peers of older
+// versions have no ID.
+func (t *peerTable) byID(id string) *Peer {
+	if id == "" {
+		return nil
+	}
+	for _, p := range t.peers {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// probed records the result of a health probe of the peer at authAddr. It
+// returns the updated peer and the event to report, if any.
+func (t *peerTable) probed(authAddr string, healthy bool) (Peer, *PeerEventType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.peers[authAddr]
+	if !found || p.Healthy == healthy {
+		return Peer{}, nil
+	}
+	p.Healthy = healthy
+	ev := PeerUpdated
+	return *p, &ev
+}
+
+// returns true the first time it is called for a peer that is healthy, when
+// it must be sent to DiscoveredPeers
+func (t *peerTable) report(authAddr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.peers[authAddr]
+	if !found || !p.Healthy || t.reported[authAddr] {
+		return false
+	}
+	t.reported[authAddr] = true
+	return true
+}
+
+// returns true if the peer at authAddr has been verified after since
+func (t *peerTable) verifiedSince(authAddr string, since time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.peers[authAddr]
+	return found && p.LastVerified.After(since)
+}
+
+// returns true if there is a peer at authAddr
+func (t *peerTable) known(authAddr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, found := t.peers[authAddr]
+	return found
+}
+
+// returns the address of the peer with a node ID, "" if there is none
+func (t *peerTable) authAddrOf(id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p := t.byID(id); p != nil {
+		return p.AuthAddr
+	}
+	return ""
+}
+
+// returns a copy of all the known peers, sorted by address
+func (t *peerTable) snapshot() []Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := make([]Peer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].AuthAddr < peers[j].AuthAddr })
+	return peers
+}
+
+// returns the number of known peers
+func (t *peerTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.peers)
+}
+
+// returns the number of known peers that are healthy
+func (t *peerTable) healthy() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, p := range t.peers {
+		if p.Healthy {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package discover
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerTable(t *testing.T) {
+	table := newPeerTable()
+	now := time.Now()
+
+	p, ev := table.verified("10.0.0.1:4000", Peer{Addr: "10.0.0.1:80", Port: 80}, now)
+	if ev == nil || *ev != PeerJoined {
+		t.Fatalf("Wanted a %v event, got %v", PeerJoined, ev)
+	}
+	if p.AuthAddr != "10.0.0.1:4000" || !p.FirstSeen.Equal(now) {
+		t.Errorf("Unexpected peer %+v", p)
+	}
+
+	// verifying again with the same port is not an event
+	if _, ev := table.verified("10.0.0.1:4000", Peer{Addr: "10.0.0.1:80", Port: 80}, now); ev != nil {
+		t.Errorf("Wanted no event, got %v", *ev)
+	}
+
+	// a different advertised port is an update
+	p, ev = table.verified("10.0.0.1:4000", Peer{Addr: "10.0.0.1:81", Port: 81}, now.Add(time.Second))
+	if ev == nil || *ev != PeerUpdated {
+		t.Fatalf("Wanted a %v event, got %v", PeerUpdated, ev)
+	}
+	if !p.FirstSeen.Equal(now) || p.Port != 81 {
+		t.Errorf("Unexpected peer %+v", p)
+	}
+
+	// peers are expired after maxFailures
+	if _, removed := table.failed("10.0.0.1:4000", 2); removed {
+		t.Errorf("Peer removed after one failure")
+	}
+	if _, removed := table.failed("10.0.0.1:4000", 2); !removed {
+		t.Errorf("Peer not removed after two failures")
+	}
+	if n := table.len(); n != 0 {
+		t.Errorf("Wanted an empty table, got %d peers", n)
+	}
+}
+
+func TestPeerRoaming(t *testing.T) {
+	table := newPeerTable()
+	now := time.Now()
+
+	table.verified("10.0.0.1:4000", Peer{Addr: "10.0.0.1:80", Port: 80, ID: "a"}, now)
+	table.verified("10.0.0.1:4001", Peer{Addr: "10.0.0.1:81", Port: 81, ID: "b"}, now)
+
+	// the same node at another address has moved
+	p, ev := table.verified("10.0.0.2:4000", Peer{Addr: "10.0.0.2:80", Port: 80, ID: "a"}, now.Add(time.Second))
+	if ev == nil || *ev != PeerUpdated {
+		t.Fatalf("Wanted a %v event, got %v", PeerUpdated, ev)
+	}
+	if p.AuthAddr != "10.0.0.2:4000" || !p.FirstSeen.Equal(now) {
+		t.Errorf("Unexpected peer %+v", p)
+	}
+	if n := table.len(); n != 2 {
+		t.Errorf("Wanted 2 peers, got %d", n)
+	}
+
+	// nodes without ID never move
+	table.verified("10.0.0.3:4000", Peer{Addr: "10.0.0.3:80", Port: 80}, now)
+	if _, ev := table.verified("10.0.0.4:4000", Peer{Addr: "10.0.0.4:80", Port: 80}, now); ev == nil || *ev != PeerJoined {
+		t.Errorf("Wanted a %v event, got %v", PeerJoined, ev)
+	}
+}
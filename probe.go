@@ -0,0 +1,53 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// health probes
+///////////////////////////////////////////////////////////////////////
+
+// A Probe checks that the application of a verified peer works, e.g. that
+// its port accepts connections. It returns an error if it does not, or if ctx
+// is done first. See Config.Probe.
+type Probe func(ctx context.Context, peer Peer) error
+
+// ProbeTCP returns a probe connecting to the application port of the peer.
+func ProbeTCP() Probe {
+	return func(ctx context.Context, peer Peer) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", peer.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// ProbeHTTP returns a probe getting path from the application of the peer,
+// which must answer with a 2xx status. A "/" is added before path if needed.
+func ProbeHTTP(path string) Probe {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return func(ctx context.Context, peer Peer) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer.Addr+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package discover
+
+import (
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// DHT query scheduler
+///////////////////////////////////////////////////////////////////////
+
+// The scheduler decides how long to wait between DHT queries. While we know
+// fewer than minPeers verified peers it queries aggressively, every
+// fastInterval. Once minPeers is reached it backs off exponentially up to
+// slowInterval, and it goes back to the aggressive mode as soon as the number
+// of verified peers drops below minPeers again.
+type scheduler struct {
+	minPeers     int
+	fastInterval time.Duration
+	slowInterval time.Duration
+
+	current time.Duration
+}
+
+func newScheduler(minPeers int, fastInterval, slowInterval time.Duration) *scheduler {
+	if slowInterval < fastInterval {
+		slowInterval = fastInterval
+	}
+	return &scheduler{
+		minPeers:     minPeers,
+		fastInterval: fastInterval,
+		slowInterval: slowInterval,
+		current:      fastInterval,
+	}
+}
+
+// returns true if we still need to find more peers
+func (s *scheduler) aggressive(verified int) bool {
+	return verified < s.minPeers
+}
+
+// next returns the time to wait before the next query, given the number of
+// verified peers we currently know.
+func (s *scheduler) next(verified int) time.Duration {
+	if s.aggressive(verified) {
+		s.current = s.fastInterval
+	} else {
+		s.current *= 2
+		if s.current > s.slowInterval {
+			s.current = s.slowInterval
+		}
+	}
+	return s.current
+}
@@ -0,0 +1,30 @@
+package discover
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackoff(t *testing.T) {
+	s := newScheduler(2, 500*time.Millisecond, 4*time.Second)
+
+	if d := s.next(0); d != 500*time.Millisecond {
+		t.Errorf("Wanted the fast interval with no peers, got %v", d)
+	}
+	if d := s.next(1); d != 500*time.Millisecond {
+		t.Errorf("Wanted the fast interval below minPeers, got %v", d)
+	}
+
+	// backs off exponentially up to the steady-state interval
+	want := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, w := range want {
+		if d := s.next(2); d != w {
+			t.Errorf("Step %d: wanted %v, got %v", i, w, d)
+		}
+	}
+
+	// and ramps up again when the verified set shrinks
+	if d := s.next(1); d != 500*time.Millisecond {
+		t.Errorf("Wanted the fast interval after losing peers, got %v", d)
+	}
+}
@@ -0,0 +1,162 @@
+package discover
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/nictuku/dht"
+)
+
+// name of the service created by NewDiscoverer
+const DEFAULT_SERVICE = "default"
+
+/////////////////////////////////////////////////////////////////////////
+
+// A service is a group of sibling nodes sharing a passphrase, e.g. all the
+// DNS servers or all the LDAP servers of a network. A Discoverer can look for
+// several services at the same time, using the same DHT node and the same
+// authentication port for all of them.
+//
+// If AppPort is a positive number, we advertise that our application for this
+// service is on port AppPort of the current host. If it's not, we only look
+// for other peers of the service.
+//
+// If Config.InfoHashEpoch is set, the infohash of the service changes every
+// epoch, so that the DHT cannot be watched for its members for long. We
+// announce ourselves and look for peers under the infohashes of the current
+// and adjacent epochs, so clocks don't have to be in sync.
+//
+// The infohashes and the MAC key are derived from the passphrase with the
+// scheme in Config.KDF. With Config.LegacyKDF, we also use the infohashes and
+// the MAC key of KDF_LEGACY, so older nodes can still find us.
+type Service struct {
+	Name            string
+	AppPort         int
+	DiscoveredPeers chan Peer // verified peers of this service, see Discoverer.Start
+
+	passphrase []byte
+	kdf        byte          // key derivation scheme
+	keySets    []*keySet     // keys of kdf, then those of KDF_LEGACY with legacyKDF
+	noise      bool          // if true, peers are verified with Noise handshakes
+	legacyKDF  bool          // if true, we use KDF_LEGACY too
+	epoch      time.Duration // lifetime of the rotating infohashes, 0 if static
+	lookupOnly bool          // if true, we never announce the service
+	peers      *peerTable
+	wake       chan struct{} // wakes up the DHT queries after losing peers
+}
+
+// creates a service with the key derivation scheme, the epoch and the
+// handshake in config. Its keys are derived at once, so a scheme that fails
+// is reported here.
+func newService(name string, appPort int, passphrase []byte, config *Config) (*Service, error) {
+	s := &Service{
+		Name:            name,
+		AppPort:         appPort,
+		DiscoveredPeers: make(chan Peer, LEN_DISCOVERED_PEERS),
+		passphrase:      passphrase,
+		kdf:             config.KDF,
+		noise:           config.Noise,
+		legacyKDF:       config.LegacyKDF,
+		epoch:           config.InfoHashEpoch,
+		peers:           newPeerTable(),
+		wake:            make(chan struct{}, 1),
+	}
+	for _, version := range kdfVersions(s.kdf, s.legacyKDF) {
+		keys, err := deriveKeys(passphrase, version)
+		if err != nil {
+			return nil, err
+		}
+		s.keySets = append(s.keySets, keys)
+	}
+	return s, nil
+}
+
+// Peers returns a snapshot of the verified peers of this service.
+func (s *Service) Peers() []Peer {
+	return s.peers.snapshot()
+}
+
+// InfoHash returns the current infohash of the service in the DHT, as raw
+// bytes.
+func (s *Service) InfoHash() string {
+	return string(s.infoHashes(time.Now())[0])
+}
+
+// returns the keys derived from the passphrase with the scheme of the service
+func (s *Service) keys() *keySet {
+	return s.keySets[0]
+}
+
+// returns the infohashes the service is announced and looked for under at
+// time now: the static one, or those of the current, previous and next
+// epochs. The current one comes first.
+func (s *Service) infoHashes(now time.Time) []dht.InfoHash {
+	var ihs []dht.InfoHash
+	for _, keys := range s.keySets {
+		if s.epoch <= 0 {
+			ihs = append(ihs, infoHash(keys.seed))
+		} else {
+			n := now.UnixNano() / int64(s.epoch)
+			ihs = append(ihs, epochInfoHash(keys.seed, n), epochInfoHash(keys.seed, n-1), epochInfoHash(keys.seed, n+1))
+		}
+	}
+	return ihs
+}
+
+// returns true if ih is one of the infohashes of the service at time now
+func (s *Service) hasInfoHash(ih dht.InfoHash, now time.Time) bool {
+	for _, x := range s.infoHashes(now) {
+		if x == ih {
+			return true
+		}
+	}
+	return false
+}
+
+// Announced returns true if we announce ourselves as a peer of this service.
+func (s *Service) Announced() bool {
+	return s.announced()
+}
+
+// returns true if we announce ourselves as a peer of this service
+func (s *Service) announced() bool {
+	return s.AppPort > 0 && !s.lookupOnly
+}
+
+// infohash used for the lookups of a passphrase, from the seed derived from
+// it. This should be somewhat hard to guess but it's not exactly a secret.
+func infoHash(seed []byte) dht.InfoHash {
+	// Mainline DHT uses sha1.
+	h160 := sha1.New()
+	h160.Write(seed)
+	h3 := h160.Sum(nil)
+	return dht.InfoHash(h3[:])
+}
+
+// infohash used for the lookups of a passphrase during an epoch. Without the
+// passphrase, the infohashes of two epochs cannot be linked.
+func epochInfoHash(seed []byte, epoch int64) dht.InfoHash {
+	var e [8]byte
+	binary.BigEndian.PutUint64(e[:], uint64(epoch))
+
+	h160 := sha1.New()
+	h160.Write(seed)
+	h160.Write(e[:])
+	h3 := h160.Sum(nil)
+	return dht.InfoHash(h3[:])
+}
+
+// the infohash seed of KDF_LEGACY
+func infoHashSeed(passphrase []byte) []byte {
+	// SHA256 of the passphrase.
+	h256 := sha256.New()
+	h256.Write(passphrase)
+	h := h256.Sum(nil)
+
+	// Assuming perfect rainbow databases, it's better if the infohash does not
+	// give out too much about the passphrase. Take half of this hash, then
+	// generate a SHA1 hash from it.
+	return h[0 : sha256.Size/2]
+}
@@ -0,0 +1,50 @@
+package discover
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInfoHashEpoch(t *testing.T) {
+	config := DefaultConfig()
+	s, _ := newService(DEFAULT_SERVICE, 3000, []byte("secret"), &config)
+	now := time.Now()
+	static := infoHash(s.keys().seed)
+	if ihs := s.infoHashes(now); len(ihs) != 1 || ihs[0] != static {
+		t.Errorf("Expected the static infohash, got %v", ihs)
+	}
+
+	s.epoch = time.Hour
+	current := s.infoHashes(now)
+	if len(current) != 3 || current[0] == static || current[0] == current[1] {
+		t.Fatalf("Unexpected epoch infohashes %v", current)
+	}
+	// a peer whose clock is one epoch ahead must still be found
+	next := s.infoHashes(now.Add(time.Hour))
+	if next[0] != current[2] || next[1] != current[0] {
+		t.Errorf("Adjacent epochs do not overlap: %v %v", current, next)
+	}
+	if !s.hasInfoHash(next[0], now) || s.hasInfoHash(next[2], now) {
+		t.Errorf("hasInfoHash does not match the adjacent epochs")
+	}
+	other, _ := newService("other", 3000, []byte("other"), &config)
+	other.epoch = time.Hour
+	if other.hasInfoHash(current[0], now) {
+		t.Errorf("Infohash shared by two passphrases")
+	}
+}
+
+func TestServiceKeys(t *testing.T) {
+	config := DefaultConfig()
+	config.LegacyKDF = true
+	s, err := newService(DEFAULT_SERVICE, 3000, []byte("secret"), &config)
+	if err != nil || len(s.keySets) != 2 || s.keys().version != config.KDF {
+		t.Fatalf("Unexpected keys %+v (%v)", s.keySets, err)
+	}
+
+	// a scheme that cannot derive the keys is an error, not a panic
+	config.KDF = KDF_SCRYPT + 1
+	if _, err := newService(DEFAULT_SERVICE, 3000, []byte("secret"), &config); err != ERR_UNKNOWN_KDF {
+		t.Errorf("Wanted ERR_UNKNOWN_KDF, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package discover
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+///////////////////////////////////////////////////////////////////////
+// session keys
+///////////////////////////////////////////////////////////////////////
+
+// A verification with FLAG_MUTUAL or with Noise leaves both peers with a
+// shared secret, so their applications can secure a channel between them
+// without another key exchange. The client gets it in Response.Session and
+// Peer.Session, and the server passes it to AuthServer.OnSession. The client
+// can send the ID of the session to the server, so it knows which secret to
+// use.
+//
+// After a mutual handshake, the secret is derived from the encryption key of
+// the passphrase and the transcript, which has the challenge and the nonce:
+// it is unique to the handshake, but any node knowing the passphrase that
+// sees the handshake can derive it too. After a Noise handshake it is derived
+// from the keys of the handshake, and it has forward secrecy. One-shot
+// challenges have no session.
+type Session struct {
+	ID  []byte // identifies the session to both peers, it is not secret
+	Key []byte // the shared secret
+}
+
+// returns the session derived from a secret and what binds it to a handshake
+func newSession(secret, binding []byte) *Session {
+	id := sha256.Sum256(append([]byte("discover session id"), binding...))
+	return &Session{
+		ID:  id[:16],
+		Key: transcriptMAC(secret, "discover session", binding),
+	}
+}
+
+// ExportKeyingMaterial returns length bytes derived from the session key
+// with a label and a context, as in RFC 5705, so the application can derive
+// as many keys as it needs. It returns ERR_NO_SESSION without a session, and
+// an error if length is not between 1 and 255*32 bytes, the most HKDF can
+// derive.
+func (s *Session) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if s == nil || len(s.Key) == 0 {
+		return nil, ERR_NO_SESSION
+	}
+	if length <= 0 || length > 255*sha256.Size {
+		return nil, fmt.Errorf("cannot export %d bytes of keying material", length)
+	}
+	info := append([]byte(label), 0)
+	info = binary.LittleEndian.AppendUint16(info, uint16(len(context)))
+	info = append(info, context...)
+	key := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, s.Key, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
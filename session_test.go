@@ -0,0 +1,64 @@
+package discover
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	passphrase := []byte("secret")
+	for _, noise := range []bool{false, true} {
+		config := DefaultConfig()
+		config.Noise = noise
+		config.VerifyRetries = 1
+		sessions := make(chan *Session, 1)
+		config.OnSession = func(addr string, session *Session) { sessions <- session }
+
+		server := newAuthServer("127.0.0.1:0", 3000, passphrase, &config)
+		startServer(t, server)
+
+		client := newAuthClient(0, passphrase, &config)
+		response, err := client.Verify(server.Addr().String())
+		if err != nil {
+			t.Fatalf("auth: %v", err)
+		}
+		session := <-sessions
+		if response.Session == nil || !bytes.Equal(response.Session.ID, session.ID) ||
+			!bytes.Equal(response.Session.Key, session.Key) {
+			t.Fatalf("Noise %v: client has session %+v, server %+v", noise, response.Session, session)
+		}
+
+		// both sides export the same keys, which depend on the label and
+		// the context
+		clientKey, err := response.Session.ExportKeyingMaterial("app", []byte("ctx"), 64)
+		if err != nil || len(clientKey) != 64 {
+			t.Fatalf("ExportKeyingMaterial: %v", err)
+		}
+		serverKey, _ := session.ExportKeyingMaterial("app", []byte("ctx"), 64)
+		otherLabel, _ := session.ExportKeyingMaterial("other", []byte("ctx"), 64)
+		otherContext, _ := session.ExportKeyingMaterial("app", nil, 64)
+		if !bytes.Equal(clientKey, serverKey) || bytes.Equal(clientKey, otherLabel) || bytes.Equal(clientKey, otherContext) {
+			t.Errorf("Noise %v: unexpected exported keys", noise)
+		}
+		if key, err := session.ExportKeyingMaterial("app", nil, 255*32); err != nil || len(key) != 255*32 {
+			t.Errorf("Noise %v: could not export the most keying material: %v", noise, err)
+		}
+		for _, length := range []int{0, -1, 255*32 + 1} {
+			if _, err := session.ExportKeyingMaterial("app", nil, length); err == nil {
+				t.Errorf("Noise %v: expected an error exporting %d bytes, got nil", noise, length)
+			}
+		}
+
+		// every handshake has its own session
+		client.Verify(server.Addr().String())
+		if next := <-sessions; bytes.Equal(next.Key, session.Key) || bytes.Equal(next.ID, session.ID) {
+			t.Errorf("Noise %v: session reused", noise)
+		}
+	}
+
+	// responses to one-shot challenges have none
+	var response Response
+	if _, err := response.Session.ExportKeyingMaterial("app", nil, 32); err != ERR_NO_SESSION {
+		t.Errorf("Wanted ERR_NO_SESSION, got %v", err)
+	}
+}
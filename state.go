@@ -0,0 +1,65 @@
+package discover
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// persistent state
+///////////////////////////////////////////////////////////////////////
+
+// What we save across restarts: good DHT nodes, for joining the DHT
+// faster, and recently verified peers, which are verified again as soon as
+// we start.
+type state struct {
+	Nodes []string    `json:"nodes"`
+	Peers []statePeer `json:"peers"`
+}
+
+// A verified peer in the state file.
+type statePeer struct {
+	Service  string    `json:"service"`
+	AuthAddr string    `json:"auth_addr"`
+	Addr     string    `json:"addr"`
+	Port     uint16    `json:"port"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// loads the state from path. A missing file is an empty state.
+func loadState(path string) (*state, error) {
+	st := new(state)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// saves the state to path, replacing the previous file atomically
+func (st *state) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
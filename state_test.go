@@ -0,0 +1,38 @@
+package discover
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// a missing file is an empty state
+	if st, err := loadState(path); err != nil || len(st.Nodes) != 0 || len(st.Peers) != 0 {
+		t.Fatalf("Wanted an empty state, got %+v, %v", st, err)
+	}
+
+	want := &state{
+		Nodes: []string{"1.2.3.4:6881"},
+		Peers: []statePeer{{
+			Service:  DEFAULT_SERVICE,
+			AuthAddr: "10.0.0.1:4000",
+			Addr:     "10.0.0.1:80",
+			Port:     80,
+			LastSeen: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+	if err := want.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	got, err := loadState(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wanted %+v, got %+v", want, got)
+	}
+}
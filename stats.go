@@ -0,0 +1,223 @@
+package discover
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// statistics
+///////////////////////////////////////////////////////////////////////
+
+// Stats is a snapshot of the counters of a Discoverer. Outcomes and reasons
+// are "ok" or the short name of one of our errors, e.g. "did_not_respond"
+// for ERR_DID_NOT_RESPOND.
+type Stats struct {
+	Lookups       map[string]uint64 // queries sent, by backend ("dht", "lan", ...)
+	Candidates    map[string]uint64 // candidates received, by backend
+	Verifications map[string]uint64 // verifications, by outcome
+	VerifyLatency Histogram         // of the successful verifications
+
+	ChallengesAnswered uint64
+	ChallengesRejected map[string]uint64 // by reason, e.g. "bad_magic"
+
+	Probes map[string]uint64 // health probes, by outcome ("ok" or "failed")
+
+	Peers map[string]int // verified peers, by service
+}
+
+// A Histogram counts durations in buckets, Prometheus style: Counts[i] is the
+// number of durations not longer than Bounds[i].
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64 // all the durations, including the longer ones
+	Sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	for i, bound := range h.Bounds {
+		if d <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// the counters, shared by the Discoverer and its AuthServer
+type metrics struct {
+	mu            sync.Mutex
+	lookups       map[string]uint64
+	candidates    map[string]uint64
+	verifications map[string]uint64
+	latency       Histogram
+	answered      uint64
+	rejected      map[string]uint64
+	probes        map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		lookups:       make(map[string]uint64),
+		candidates:    make(map[string]uint64),
+		verifications: make(map[string]uint64),
+		latency:       newHistogram(LATENCY_BUCKETS),
+		rejected:      make(map[string]uint64),
+		probes:        make(map[string]uint64),
+	}
+}
+
+func (m *metrics) lookup(backend string) {
+	m.mu.Lock()
+	m.lookups[backend]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) candidate(source string) {
+	m.mu.Lock()
+	m.candidates[source]++
+	m.mu.Unlock()
+}
+
+// records the outcome of a verification that took d
+func (m *metrics) verification(err error, d time.Duration) {
+	m.mu.Lock()
+	m.verifications[errorKind(err)]++
+	if err == nil {
+		m.latency.observe(d)
+	}
+	m.mu.Unlock()
+}
+
+// records a challenge we answered, or rejected because of err
+func (m *metrics) challenge(err error) {
+	m.mu.Lock()
+	if err == nil {
+		m.answered++
+	} else {
+		m.rejected[errorKind(err)]++
+	}
+	m.mu.Unlock()
+}
+
+// records the result of a health probe
+func (m *metrics) probe(err error) {
+	m.mu.Lock()
+	if err == nil {
+		m.probes["ok"]++
+	} else {
+		m.probes["failed"]++
+	}
+	m.mu.Unlock()
+}
+
+func (m *metrics) snapshot() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latency := m.latency
+	latency.Counts = append([]uint64(nil), m.latency.Counts...)
+	return Stats{
+		Lookups:            copyCounters(m.lookups),
+		Candidates:         copyCounters(m.candidates),
+		Verifications:      copyCounters(m.verifications),
+		VerifyLatency:      latency,
+		ChallengesAnswered: m.answered,
+		ChallengesRejected: copyCounters(m.rejected),
+		Probes:             copyCounters(m.probes),
+		Peers:              make(map[string]int),
+	}
+}
+
+func copyCounters(counters map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counters))
+	for k, v := range counters {
+		c[k] = v
+	}
+	return c
+}
+
+// Stats returns a snapshot of the counters.
+func (this *Discoverer) Stats() Stats {
+	stats := this.metrics.snapshot()
+	for _, s := range this.Services() {
+		stats.Peers[s.Name] = s.peers.len()
+	}
+	return stats
+}
+
+// StatsHandler returns an HTTP handler serving the counters in the Prometheus
+// text format.
+func (this *Discoverer) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		this.Stats().WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the counters in the Prometheus text format.
+func (s Stats) WritePrometheus(w io.Writer) error {
+	ew := &errWriter{w: w}
+	writeCounters(ew, "discover_lookups_total", "Queries sent to the backends.", "backend", s.Lookups)
+	writeCounters(ew, "discover_candidates_total", "Candidate peers received from the backends.", "backend", s.Candidates)
+	writeCounters(ew, "discover_verifications_total", "Verifications of candidate and known peers.", "outcome", s.Verifications)
+
+	challenges := copyCounters(s.ChallengesRejected)
+	challenges["ok"] = s.ChallengesAnswered
+	writeCounters(ew, "discover_challenges_total", "Challenges received by the authentication server.", "outcome", challenges)
+
+	writeCounters(ew, "discover_probes_total", "Health probes of the verified peers.", "outcome", s.Probes)
+
+	ew.printf("# HELP discover_verify_latency_seconds Time taken by the successful verifications.\n")
+	ew.printf("# TYPE discover_verify_latency_seconds histogram\n")
+	for i, bound := range s.VerifyLatency.Bounds {
+		ew.printf("discover_verify_latency_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), s.VerifyLatency.Counts[i])
+	}
+	ew.printf("discover_verify_latency_seconds_bucket{le=\"+Inf\"} %d\n", s.VerifyLatency.Count)
+	ew.printf("discover_verify_latency_seconds_sum %g\n", s.VerifyLatency.Sum.Seconds())
+	ew.printf("discover_verify_latency_seconds_count %d\n", s.VerifyLatency.Count)
+
+	ew.printf("# HELP discover_peers Verified peers.\n")
+	ew.printf("# TYPE discover_peers gauge\n")
+	for _, name := range sortedKeys(s.Peers) {
+		ew.printf("discover_peers{service=%q} %d\n", name, s.Peers[name])
+	}
+	return ew.err
+}
+
+func writeCounters(ew *errWriter, name, help, label string, counters map[string]uint64) {
+	ew.printf("# HELP %s %s\n", name, help)
+	ew.printf("# TYPE %s counter\n", name)
+	for _, k := range sortedKeys(counters) {
+		ew.printf("%s{%s=%q} %d\n", name, label, k, counters[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// a writer that remembers the first error and then does nothing
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
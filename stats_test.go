@@ -0,0 +1,51 @@
+package discover
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	m := newMetrics()
+	m.lookup("dht")
+	m.lookup("dht")
+	m.candidate("static")
+	m.verification(nil, 20*time.Millisecond)
+	m.verification(ERR_DID_NOT_RESPOND, time.Second)
+	m.challenge(nil)
+	m.challenge(ERR_BAD_MAGIC)
+
+	s := m.snapshot()
+	if s.Lookups["dht"] != 2 || s.Candidates["static"] != 1 {
+		t.Errorf("Unexpected lookups or candidates: %+v", s)
+	}
+	if s.Verifications["ok"] != 1 || s.Verifications["did_not_respond"] != 1 {
+		t.Errorf("Unexpected verifications: %v", s.Verifications)
+	}
+	if s.ChallengesAnswered != 1 || s.ChallengesRejected["bad_magic"] != 1 {
+		t.Errorf("Unexpected challenges: %+v", s)
+	}
+	// only the successful verification is in the histogram
+	if s.VerifyLatency.Count != 1 || s.VerifyLatency.Counts[0] != 0 || s.VerifyLatency.Counts[2] != 1 {
+		t.Errorf("Unexpected latency histogram: %+v", s.VerifyLatency)
+	}
+
+	var buf bytes.Buffer
+	s.Peers["default"] = 3
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`discover_lookups_total{backend="dht"} 2`,
+		`discover_challenges_total{outcome="bad_magic"} 1`,
+		`discover_verify_latency_seconds_bucket{le="0.025"} 1`,
+		`discover_verify_latency_seconds_bucket{le="+Inf"} 1`,
+		`discover_peers{service="default"} 3`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%q not found in:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package discover
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+///////////////////////////////////////////////////////////////////////
+// v2 framing
+///////////////////////////////////////////////////////////////////////
+
+// Framings of the messages of the handshake. WIRE_V1 messages are the structs
+// in challenge.go, written with binary.Write. WIRE_V2 messages are frames
+// with the 8 bytes of magicHeader, a version byte, a message type byte and
+// then TLV fields: a 1 byte type, a 2 byte little endian length and the
+// value. Fields of unknown types are ignored, so new ones can be added
+// without a new version. The MACs are the same with both framings.
+//
+// Servers answer with the framing of the client. Clients send v2 frames, and
+// fall back to v1 for the peers that do not answer them, as older servers
+// take them for challenges with an unknown key hint.
+const (
+	WIRE_V1 = 1
+	WIRE_V2 = 2
+)
+
+// Message types of the v2 frames.
+const (
+	MSG_CHALLENGE = 1
+	MSG_NONCE     = 2
+	MSG_PROOF     = 3
+	MSG_RESPONSE  = 4
+
+	MSG_NOISE_INIT     = 5 // see noise.go
+	MSG_NOISE_RESPONSE = 6
+	MSG_NOISE_COOKIE   = 7
+)
+
+// Field types of the v2 frames.
+const (
+	TLV_DEDUPE    = 1
+	TLV_CHALLENGE = 2
+	TLV_KEY_HINT  = 3
+	TLV_KDF       = 4
+	TLV_FLAGS     = 5
+	TLV_NONCE     = 6
+	TLV_MAC       = 7
+	TLV_PORT      = 8
+	TLV_SECTIONS  = 9  // the sections of a response, as in v1
+	TLV_NOISE     = 10 // a Noise handshake message
+	TLV_COOKIE    = 11 // the cookie of a Noise handshake
+)
+
+// The fields every request must have, by message type. The v2 frames have no
+// length, so on TCP a frame ends with the last of the fields of its message.
+var requestFields = map[byte][]byte{
+	MSG_CHALLENGE:  {TLV_DEDUPE, TLV_CHALLENGE, TLV_KEY_HINT, TLV_KDF, TLV_FLAGS},
+	MSG_PROOF:      {TLV_DEDUPE, TLV_CHALLENGE, TLV_KEY_HINT, TLV_KDF, TLV_FLAGS, TLV_NONCE, TLV_MAC},
+	MSG_NOISE_INIT: {TLV_KEY_HINT, TLV_KDF, TLV_NOISE},
+}
+
+// the header of a v2 frame, without the message type
+var frameHeader = append(bytes.Clone(magicHeader), WIRE_V2)
+
+// A message of the handshake, which can be sent with either framing.
+type message interface {
+	ToBuffer() (*bytes.Buffer, error)
+	frame() []byte
+}
+
+// returns msg with a framing
+func encodeMessage(msg message, version byte) ([]byte, error) {
+	if version == WIRE_V2 {
+		return msg.frame(), nil
+	}
+	buf, err := msg.ToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// a field of a v2 frame
+type tlv struct {
+	typ   byte
+	value []byte
+}
+
+// returns a v2 frame
+func encodeFrame(msgType byte, fields ...tlv) []byte {
+	buf := append(bytes.Clone(frameHeader), msgType)
+	for _, f := range fields {
+		buf = append(buf, f.typ)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(f.value)))
+		buf = append(buf, f.value...)
+	}
+	return buf
+}
+
+// returns true if buf looks like a v2 frame. A v1 challenge could start with
+// the same bytes, but then it would also have to decode as valid fields.
+func isFrame(buf []byte) bool {
+	return len(buf) > len(frameHeader) && bytes.Equal(buf[:len(frameHeader)], frameHeader)
+}
+
+// decodes a v2 frame, returning its message type and its fields by type
+func decodeFrame(buf []byte) (byte, map[byte][]byte, error) {
+	if !isFrame(buf) {
+		return 0, nil, ERR_IS_NOT_PEER
+	}
+	msgType := buf[len(frameHeader)]
+	fields := make(map[byte][]byte)
+	for rest := buf[len(frameHeader)+1:]; len(rest) > 0; {
+		if len(rest) < 3 {
+			return 0, nil, ERR_IS_NOT_PEER
+		}
+		typ, n := rest[0], 3+int(binary.LittleEndian.Uint16(rest[1:]))
+		if len(rest) < n {
+			return 0, nil, ERR_IS_NOT_PEER
+		}
+		if _, found := fields[typ]; found {
+			return 0, nil, ERR_IS_NOT_PEER
+		}
+		fields[typ] = rest[3:n]
+		rest = rest[n:]
+	}
+	return msgType, fields, nil
+}
+
+// copies the field typ, which must be as long as dst
+func fixedField(fields map[byte][]byte, typ byte, dst []byte) error {
+	value, found := fields[typ]
+	if !found || len(value) != len(dst) {
+		return ERR_IS_NOT_PEER
+	}
+	copy(dst, value)
+	return nil
+}
+
+// copies the fields of a challenge
+func challengeFields(fields map[byte][]byte, challenge *Challenge) error {
+	copy(challenge.MagicHeader[:], magicHeader)
+	for _, f := range []struct {
+		typ byte
+		dst []byte
+	}{
+		{TLV_DEDUPE, challenge.Dedupe[:]},
+		{TLV_CHALLENGE, challenge.Challenge[:]},
+		{TLV_KEY_HINT, challenge.KeyHint[:]},
+		{TLV_KDF, []byte{0}},
+		{TLV_FLAGS, []byte{0}},
+	} {
+		if err := fixedField(fields, f.typ, f.dst); err != nil {
+			return err
+		}
+	}
+	challenge.KDF = fields[TLV_KDF][0]
+	challenge.Flags = fields[TLV_FLAGS][0]
+	return nil
+}
+
+// the fields of a challenge
+func (challenge *Challenge) fields() []tlv {
+	return []tlv{
+		{TLV_DEDUPE, challenge.Dedupe[:]},
+		{TLV_CHALLENGE, challenge.Challenge[:]},
+		{TLV_KEY_HINT, challenge.KeyHint[:]},
+		{TLV_KDF, []byte{challenge.KDF}},
+		{TLV_FLAGS, []byte{challenge.Flags}},
+	}
+}
+
+func (challenge *Challenge) frame() []byte {
+	return encodeFrame(MSG_CHALLENGE, challenge.fields()...)
+}
+
+func (proof *Proof) frame() []byte {
+	fields := append(proof.Challenge.fields(), tlv{TLV_NONCE, proof.Nonce[:]}, tlv{TLV_MAC, proof.MAC[:]})
+	return encodeFrame(MSG_PROOF, fields...)
+}
+
+func (nonce *Nonce) frame() []byte {
+	return encodeFrame(MSG_NONCE,
+		tlv{TLV_DEDUPE, nonce.Dedupe[:]},
+		tlv{TLV_CHALLENGE, nonce.Challenge[:]},
+		tlv{TLV_NONCE, nonce.Nonce[:]})
+}
+
+func (response *Response) frame() []byte {
+	return encodeFrame(MSG_RESPONSE,
+		tlv{TLV_PORT, binary.LittleEndian.AppendUint16(nil, response.Port)},
+		tlv{TLV_MAC, response.MAC[:]},
+		tlv{TLV_SECTIONS, response.sections})
+}
+
+// decodes a challenge or a proof sent with v2 framing
+func parseRequestFrame(buf []byte) (*Challenge, *Proof, error) {
+	msgType, fields, err := decodeFrame(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch msgType {
+	case MSG_CHALLENGE:
+		challenge := new(Challenge)
+		if err := challengeFields(fields, challenge); err != nil {
+			return nil, nil, err
+		}
+		return challenge, nil, nil
+	case MSG_PROOF:
+		proof := new(Proof)
+		if err := challengeFields(fields, &proof.Challenge); err != nil {
+			return nil, nil, err
+		}
+		if err := fixedField(fields, TLV_NONCE, proof.Nonce[:]); err != nil {
+			return nil, nil, err
+		}
+		if err := fixedField(fields, TLV_MAC, proof.MAC[:]); err != nil {
+			return nil, nil, err
+		}
+		return nil, proof, nil
+	}
+	return nil, nil, ERR_IS_NOT_PEER
+}
+
+// decodes a nonce sent with v2 framing
+func parseNonceFrame(buf []byte) (*Nonce, error) {
+	msgType, fields, err := decodeFrame(buf)
+	if err != nil || msgType != MSG_NONCE {
+		return nil, ERR_IS_NOT_PEER
+	}
+	nonce := new(Nonce)
+	copy(nonce.MagicHeader[:], magicHeader)
+	if fixedField(fields, TLV_DEDUPE, nonce.Dedupe[:]) != nil ||
+		fixedField(fields, TLV_CHALLENGE, nonce.Challenge[:]) != nil ||
+		fixedField(fields, TLV_NONCE, nonce.Nonce[:]) != nil {
+		return nil, ERR_IS_NOT_PEER
+	}
+	return nonce, nil
+}
+
+// Verify a response sent with v2 framing, as VerifyResponse.
+func (challenge *Challenge) verifyResponseFrame(buf []byte, nonce *Nonce, macKey []byte) (*Response, bool) {
+	msgType, fields, err := decodeFrame(buf)
+	if err != nil || msgType != MSG_RESPONSE {
+		return nil, false
+	}
+	response := new(Response)
+	port := make([]byte, 2)
+	if fixedField(fields, TLV_PORT, port) != nil || fixedField(fields, TLV_MAC, response.MAC[:]) != nil {
+		return nil, false
+	}
+	response.Port = binary.LittleEndian.Uint16(port)
+	return challenge.verifyResponse(response, fields[TLV_SECTIONS], nonce, macKey)
+}
@@ -0,0 +1,157 @@
+package discover
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	challenge, _ := NewChallenge()
+	challenge.KeyHint = [LEN_KEY_HINT]byte{1, 2, 3, 4}
+	challenge.KDF = KDF_SCRYPT
+	challenge.Flags = FLAG_MUTUAL | FLAG_HOSTS
+
+	// fields of unknown types are ignored
+	buf := append(challenge.frame(), 200, 1, 0, 42)
+	parsed, proof, err := parseRequestFrame(buf)
+	if err != nil || proof != nil || *parsed != *challenge {
+		t.Errorf("Wanted %+v, got %+v (%v)", challenge, parsed, err)
+	}
+
+	// but truncated and duplicate ones are not
+	for _, bad := range [][]byte{buf[:len(buf)-1], append(challenge.frame(), TLV_KDF, 1, 0, 1)} {
+		if _, _, err := parseRequestFrame(bad); err != ERR_IS_NOT_PEER {
+			t.Errorf("Wanted ERR_IS_NOT_PEER, got %v", err)
+		}
+	}
+
+	nonce := newNonce(challenge, [LEN_NONCE]byte{5})
+	if parsed, err := parseNonceFrame(nonce.frame()); err != nil || *parsed != *nonce {
+		t.Errorf("Wanted %+v, got %+v (%v)", nonce, parsed, err)
+	}
+	if _, err := parseNonceFrame(challenge.frame()); err == nil {
+		t.Errorf("Challenge parsed as a nonce")
+	}
+}
+
+// serves the challenges of an older server, which does not understand frames
+func serveV1(t *testing.T, server *AuthServer) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		buf := make([]byte, LEN_UDP_BUF)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if isFrame(buf[:n]) {
+				continue
+			}
+			if reply, _, err := server.handleMessage(addr.String(), buf[:n]); err == nil {
+				conn.WriteToUDP(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestWireNegotiation(t *testing.T) {
+	passphrase := []byte("secret")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+	v1Addr := serveV1(t, server)
+
+	client, _ := NewAuthClient(0, passphrase)
+	client.Timeout = 100
+	for _, tc := range []struct {
+		addr string
+		wire byte
+	}{
+		{server.Addr().String(), WIRE_V2},
+		{v1Addr, WIRE_V1},
+	} {
+		for i := 0; i < 2; i++ {
+			if response, err := client.Verify(tc.addr); err != nil || response.Port != 3000 {
+				t.Fatalf("auth: %v", err)
+			}
+			if wire := client.wire[tc.addr]; wire != tc.wire {
+				t.Errorf("Wanted framing %d for %s, got %d", tc.wire, tc.addr, wire)
+			}
+		}
+	}
+}
+
+func TestTCPMessages(t *testing.T) {
+	passphrase := []byte("secret")
+	server, _ := NewAuthServer("127.0.0.1:0", 3000, passphrase)
+	startServer(t, server)
+	keys, _ := deriveKeys(passphrase, DEFAULT_KDF)
+
+	for _, version := range []byte{WIRE_V2, WIRE_V1} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		// the messages arrive in two parts
+		send := func(msg []byte) {
+			conn.Write(msg[:38])
+			time.Sleep(20 * time.Millisecond)
+			if _, err := conn.Write(msg[38:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		challenge, _ := NewChallenge()
+		challenge.KeyHint = keys.hint
+		challenge.KDF = keys.version
+		challenge.Flags = FLAG_MUTUAL
+		msg, _ := encodeMessage(challenge, version)
+		nonceBuf := make([]byte, LEN_NONCE_MSG)
+		if version == WIRE_V2 {
+			// with a field of an unknown type first
+			msg = slices.Concat(msg[:len(frameHeader)+1], []byte{200, 1, 0, 42}, msg[len(frameHeader)+1:])
+			nonceBuf = make([]byte, len(newNonce(challenge, [LEN_NONCE]byte{}).frame()))
+		}
+		send(msg)
+		if _, err := io.ReadFull(conn, nonceBuf); err != nil {
+			t.Fatalf("Wire %d: no nonce: %v", version, err)
+		}
+		var nonce *Nonce
+		if version == WIRE_V2 {
+			nonce, err = parseNonceFrame(nonceBuf)
+		} else {
+			nonce, err = parseNonce(nonceBuf)
+		}
+		if err != nil {
+			t.Fatalf("Wire %d: invalid nonce: %v", version, err)
+		}
+
+		msg, _ = encodeMessage(challenge.NewProof(nonce, keys.mac), version)
+		send(msg)
+		reply, _ := io.ReadAll(conn)
+		var ok bool
+		if version == WIRE_V2 {
+			_, ok = challenge.verifyResponseFrame(reply, nonce, keys.mac)
+		} else {
+			_, ok = challenge.VerifyResponse(bytes.NewBuffer(reply), nonce, keys.mac)
+		}
+		if !ok {
+			t.Errorf("Wire %d: no valid response", version)
+		}
+	}
+}